@@ -1,11 +1,23 @@
 package main
 
 import (
+	"os"
+
 	"github.com/alecthomas/kong"
+	"github.com/juju/errors"
+	"github.com/numtide/nits/internal/cmd"
 	"github.com/numtide/nits/internal/cmd/cli"
 )
 
 func main() {
 	ctx := kong.Parse(&cli.Cmd)
-	ctx.FatalIfErrorf(ctx.Run())
+
+	err := ctx.Run()
+
+	var exit cmd.ExitError
+	if errors.As(err, &exit) {
+		os.Exit(exit.Code)
+	}
+
+	ctx.FatalIfErrorf(err)
 }
@@ -8,6 +8,9 @@ import (
 
 	"github.com/numtide/nits/internal/cmd"
 	"github.com/numtide/nits/pkg/agent"
+	"github.com/numtide/nits/pkg/agent/exec"
+	"github.com/numtide/nits/pkg/agent/nixos"
+	"github.com/numtide/nits/pkg/agent/substituter"
 )
 
 type runCmd struct{}
@@ -27,6 +30,9 @@ func (a *runCmd) Run() (err error) {
 
 	return cmd.Run(func(ctx context.Context) (err error) {
 		agent.NatsOptions = &Cmd.Nats
+		nixos.Options = &Cmd.Nixos
+		substituter.Options = &Cmd.Substituter
+		exec.Options = &Cmd.Exec
 		return agent.Run(ctx)
 	})
 }
@@ -9,6 +9,10 @@ import (
 	nsccmd "github.com/nats-io/nsc/v2/cmd"
 
 	"github.com/numtide/nits/internal/cmd"
+	"github.com/numtide/nits/pkg/agent/info"
+	"github.com/numtide/nits/pkg/agent/nixos"
+	"github.com/numtide/nits/pkg/cache"
+	"github.com/numtide/nits/pkg/maintenance"
 
 	nexec "github.com/numtide/nits/pkg/exec"
 	nutil "github.com/numtide/nits/pkg/nats"
@@ -25,6 +29,8 @@ type agentAdd struct {
 	PublicKeyFile  string `required:"" type:"existingfile" xor:"key"`
 	PrivateKeyFile string `required:"" type:"existingfile" xor:"key"`
 
+	Label map[string]string `help:"A label for the agent in the form key=value, stored as a tag in the agent's JWT, labels are case-insensitive"`
+
 	Name string `arg:"" help:"A name for the agent account"`
 }
 
@@ -33,6 +39,12 @@ func (a *agentAdd) Run() (err error) {
 		return err
 	}
 
+	// validate the labels before changing anything
+	var tags []string
+	if tags, err = info.LabelTags(a.Label); err != nil {
+		return
+	}
+
 	var nkey string
 
 	// todo move this logic somewhere shared
@@ -91,18 +103,26 @@ func (a *agentAdd) Run() (err error) {
 
 	log.Info("adding an agent user", "operator", op.Name, "account", a.Cluster, "name", a.Name)
 
-	nsc = cmd.LogExec(
-		nexec.Nsc(
-			"add", "user", "-a", a.Cluster,
-			"-k", nkey,
-			"-n", a.Name,
-			"--allow-pubsub", agentSubject,
-			"--allow-pub", subject.AgentRegistration(nkey),
-			"--allow-pub", "$JS.API.STREAM.NAMES",
-			"--allow-sub", "$SRV.>",
-			"--allow-pub", "_INBOX.>",
-		),
-	)
+	args := []string{
+		"add", "user", "-a", a.Cluster,
+		"-k", nkey,
+		"-n", a.Name,
+		"--allow-pubsub", agentSubject,
+		"--allow-pub", subject.AgentRegistration(nkey),
+		"--allow-pub", "$JS.API.STREAM.NAMES",
+		"--allow-sub", "$SRV.>",
+		"--allow-pub", "_INBOX.>",
+		"--allow-pub", subject.CacheServiceAll(),
+	}
+	args = append(args, kvWatchPermissions(nixos.DesiredStateBucket, nkey)...)
+	args = append(args, kvWatchPermissions(maintenance.Bucket, nkey)...)
+	args = append(args, objectStoreReadPermissions(cache.Bucket)...)
+
+	for _, tag := range tags {
+		args = append(args, "--tag", tag)
+	}
+
+	nsc = cmd.LogExec(nexec.Nsc(args...))
 
 	if _, err = nsc.Output(); err != nil {
 		nexec.LogError("failed to add agent user", err)
@@ -111,3 +131,26 @@ func (a *agentAdd) Run() (err error) {
 
 	return
 }
+
+// kvWatchPermissions returns the nsc arguments required for an agent to watch a single key within a KV bucket.
+func kvWatchPermissions(bucket string, key string) []string {
+	stream := "KV_" + bucket
+	return []string{
+		"--allow-pub", "$JS.API.STREAM.INFO." + stream,
+		"--allow-pub", fmt.Sprintf("$JS.API.CONSUMER.CREATE.%s.*.$KV.%s.%s", stream, bucket, key),
+		"--allow-pub", fmt.Sprintf("$JS.API.CONSUMER.DELETE.%s.*", stream),
+		"--allow-pub", fmt.Sprintf("$JS.FC.%s.>", stream),
+	}
+}
+
+// objectStoreReadPermissions returns the nsc arguments required for an agent to read objects from an object store.
+func objectStoreReadPermissions(bucket string) []string {
+	stream := "OBJ_" + bucket
+	return []string{
+		"--allow-pub", "$JS.API.STREAM.INFO." + stream,
+		"--allow-pub", "$JS.API.STREAM.MSG.GET." + stream,
+		"--allow-pub", fmt.Sprintf("$JS.API.CONSUMER.CREATE.%s.*.$O.%s.C.*", stream, bucket),
+		"--allow-pub", fmt.Sprintf("$JS.API.CONSUMER.DELETE.%s.*", stream),
+		"--allow-pub", fmt.Sprintf("$JS.FC.%s.>", stream),
+	}
+}
@@ -2,17 +2,22 @@ package cli
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/user"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/ettle/strcase"
 	"github.com/nix-community/go-nix/pkg/storepath"
 	"github.com/numtide/nits/pkg/nix"
 
 	"github.com/numtide/nits/pkg/agent"
 	"github.com/numtide/nits/pkg/agent/info"
+	"github.com/numtide/nits/pkg/cache"
 	nlog "github.com/numtide/nits/pkg/logging"
 
 	"github.com/numtide/nits/pkg/agent/nixos"
@@ -21,19 +26,33 @@ import (
 	"github.com/numtide/nits/internal/cmd"
 
 	nnats "github.com/numtide/nits/pkg/nats"
+	"github.com/numtide/nits/pkg/subject"
 
 	"github.com/juju/errors"
+	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats.go"
 )
 
 type agentDeploy struct {
 	Nats nnats.CliOptions `embed:"" prefix:"nats-"`
 
-	Action  string `enum:"switch,boot,test,dry-activate" default:"switch" help:"action to perform on the agent" `
-	Closure string `arg:"" help:"store path of the NixOS closure to deploy"`
+	Action  string `enum:"switch,boot,test,dry-activate,stage" default:"switch" help:"action to perform on the agent" `
+	Closure string `arg:"" optional:"" help:"store path of the NixOS closure to deploy"`
 
-	Output bool   `help:"output agent's stdout and stderr"`
-	Name   string `required:"" help:"the name given to the agent"`
+	Profile  string `help:"set this nix profile to the closure instead of deploying a NixOS system, for hosts which are not running NixOS"`
+	Activate string `help:"path of a script within the closure to run after setting the profile e.g. activate"`
+	User     string `help:"user to run the activation script as"`
+
+	Output   bool     `help:"output agent's stdout and stderr"`
+	Plan     bool     `help:"show the changes the deployment would make to each agent and ask for confirmation before deploying"`
+	Schedule bool     `help:"update the agent's desired state instead of deploying immediately"`
+	Attach   bool     `help:"attach to the deployment which is already in progress instead of starting a new one"`
+	Force    bool     `help:"activate immediately instead of waiting for the agent's maintenance window"`
+	Transfer bool     `help:"upload the closure to the agent over NATS rather than have it fetched from a binary cache"`
+	Name     []string `help:"the name given to the agent, multiple agents will be deployed to as a rolling deployment"`
+	Selector string   `help:"deploy to every agent whose labels match the selector e.g. site=oslo,role=gateway"`
+
+	Rollout rolloutOptions `embed:""`
 }
 
 func (d *agentDeploy) Run() error {
@@ -41,51 +60,52 @@ func (d *agentDeploy) Run() error {
 		return err
 	}
 
+	if len(d.Name) == 0 && d.Selector == "" {
+		return errors.New("either --name or --selector must be specified")
+	} else if d.Attach == (d.Closure != "") {
+		return errors.New("either a closure or --attach must be specified")
+	} else if d.Attach && (len(d.Name) > 1 || d.Selector != "") {
+		return errors.New("--attach can only be used with a single agent")
+	} else if d.Attach && d.Plan {
+		return errors.New("--plan cannot be used with --attach")
+	} else if d.Profile == "" && (d.Activate != "" || d.User != "") {
+		return errors.New("--activate and --user can only be used with --profile")
+	} else if d.Profile != "" && d.Action != "switch" {
+		return errors.New("--profile can only be used with the switch action")
+	} else if d.Profile != "" && d.Plan {
+		return errors.New("--plan cannot be used with --profile")
+	} else if err := d.Rollout.validate(); err != nil {
+		return err
+	}
+
 	return cmd.Run(func(ctx context.Context) (err error) {
-		// build the closure
-		log.Infof("building closure: %s", d.Closure)
+		var (
+			path   string
+			action nixos.DeployAction
+		)
 
-		build := exec.Command("nix", "build", "--no-link", "--refresh", "--print-out-paths", d.Closure)
-		out, err := build.Output()
-		if err != nil {
-			var exit *exec.ExitError
-			if errors.As(err, &exit) {
-				_, _ = os.Stderr.Write(exit.Stderr)
+		if !d.Attach {
+			if d.Profile != "" {
+				path, err = buildPath(d.Closure)
+			} else {
+				path, err = buildClosure(d.Closure)
+			}
+			if err != nil {
+				return
+			} else if action, err = nixos.DeployActionString(d.Action); err != nil {
+				return
 			}
-			return fmt.Errorf("%w: failed to build closure", err)
-		}
-
-		path := strings.Trim(string(out), "\n")
-		log.Infof("closure built successfully: %v", path)
-
-		// validate the closure
-		closure, err := storepath.FromAbsolutePath(path)
-		if err != nil {
-			return fmt.Errorf("%w: failed to parse system closure", err)
-		} else if err = nix.IsSystemClosure(closure); err != nil {
-			return fmt.Errorf("%w: invalid system closure %v", err, closure)
-		}
-
-		// deploy the closure
-		var action nixos.DeployAction
-		if action, err = nixos.DeployActionString(d.Action); err != nil {
-			return
-		}
-
-		req := nixos.DeployRequest{
-			Action:  action,
-			Closure: path,
 		}
 
 		var (
 			opts    []nats.Option
+			claims  *jwt.UserClaims
 			js      nats.JetStreamContext
 			conn    *nats.Conn
 			encoded *nats.EncodedConn
-			sub     *nats.Subscription
 		)
 
-		if opts, _, _, err = d.Nats.ToNatsOptions(); err != nil {
+		if opts, _, claims, err = d.Nats.ToNatsOptions(); err != nil {
 			return
 		} else if conn, err = nats.Connect(d.Nats.Url, opts...); err != nil {
 			return
@@ -95,18 +115,20 @@ func (d *agentDeploy) Run() error {
 			return
 		}
 
-		log.Info("resolving agent", "name", d.Name)
+		var selector agent.Selector
+		if selector, err = agent.ParseSelector(d.Selector); err != nil {
+			return
+		}
+
+		log.Info("resolving agents", "names", d.Name, "selector", d.Selector)
 		listCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 		defer cancel()
 
 		var (
-			ok             bool
-			target         *info.Response
+			targets        []*info.Response
 			byName, byNKey map[string]*info.Response
 		)
 
-		// todo make the logs command re-usable from here
-
 		// get a list of agents and index the responses
 
 		var agents []*info.Response
@@ -118,49 +140,360 @@ func (d *agentDeploy) Run() error {
 			return
 		}
 
-		if target, ok = byName[d.Name]; ok {
-			log.Info("agent found", "name", d.Name, "nkey", target.NKey)
-		} else {
-			return errors.Errorf("could not find an agent named %s", d.Name)
+		for _, name := range d.Name {
+			if target, ok := byName[name]; ok {
+				log.Info("agent found", "name", name, "nkey", target.NKey)
+				targets = append(targets, target)
+			} else {
+				return errors.Errorf("could not find an agent named %s", name)
+			}
 		}
 
+		if d.Selector != "" {
+			selected := agent.Select(agents, selector)
+			if len(selected) == 0 {
+				return errors.Errorf("no agents match the selector '%s'", d.Selector)
+			}
+			for _, target := range selected {
+				if slices.Contains(d.Name, target.Name) {
+					continue
+				}
+				log.Info("agent selected", "name", target.Name, "nkey", target.NKey)
+				targets = append(targets, target)
+			}
+		}
+
+		// the same agent may have been named more than once
+		targets = uniqueTargets(targets)
+
 		// set agent indices in the context for the log writer
 		ctx = nlog.SetAgentsByName(ctx, byName)
 		ctx = nlog.SetAgentsByNKey(ctx, byNKey)
 
-		var resp nixos.DeployResponse
-		if resp, err = nixos.DeployWithContext(ctx, encoded, target.NKey, req); err != nil {
-			return
-		} else if sub, err = js.SubscribeSync(resp.Logs+".>", nats.DeliverAll(), nats.AckNone()); err != nil {
-			return
+		if d.Attach {
+			return attach(ctx, encoded, js, targets[0], d.Output)
 		}
 
-		log.Debug("listening for logs", "subject", resp.Logs)
-		reader := nlog.RecordReader{Sub: sub, Context: ctx}
+		req := nixos.DeployRequest{
+			Action:   action,
+			Closure:  path,
+			Force:    d.Force,
+			Profile:  d.Profile,
+			Activate: d.Activate,
+			User:     d.User,
+		}
 
-		var record nlog.Record
-		for {
-			select {
-			case <-ctx.Done():
+		if d.Transfer {
+			if req.Cache, err = transfer(ctx, js, path); err != nil {
 				return
-			default:
-				record, err = reader.Read()
-				if errors.Is(err, nats.ErrTimeout) {
-					err = nil
-					continue
-				} else if nnats.IsEndOfStreamErr(err) {
-					err = nil
-					return
-				} else if err != nil {
+			}
+		}
+
+		requests := make(map[string]nixos.DeployRequest, len(targets))
+		for _, target := range targets {
+			requests[target.NKey] = req
+		}
+
+		if d.Plan {
+			var proceed bool
+			if proceed, err = plan(ctx, encoded, targets, requests); err != nil {
+				return
+			} else if !proceed {
+				log.Info("deployment aborted")
+				return
+			}
+		}
+
+		if d.Schedule {
+			// the desired state is written by us rather than requested of the agent, so there is no request to verify
+			req.Issuer = issuer(claims)
+			for _, target := range targets {
+				var revision uint64
+				if revision, err = nixos.Schedule(js, target.NKey, req); err != nil {
 					return
 				}
+				log.Info("deployment scheduled", "name", target.Name, "revision", revision)
+			}
+			return
+		}
 
-				if !d.Output && record.Type() == nlog.RecordTerm {
-					continue
-				}
+		if len(targets) > 1 {
+			return d.Rollout.rollout(ctx, encoded, js, targets, requests, d.Output)
+		}
 
-				_, _ = record.Write(os.Stderr)
-			}
+		var result *nixos.DeployResult
+		if result, err = deployTo(ctx, encoded, js, targets[0], req, d.Output); err != nil {
+			return
 		}
+
+		return checkResult(targets[0].Name, result)
+	})
+}
+
+// deployTo deploys to a single agent, following its logs until the deployment has finished and returning the result.
+func deployTo(
+	ctx context.Context,
+	conn *nats.EncodedConn,
+	js nats.JetStreamContext,
+	target *info.Response,
+	req nixos.DeployRequest,
+	output bool,
+) (result *nixos.DeployResult, err error) {
+	return follow(ctx, conn, js, target.NKey, output, func() (nixos.DeployResponse, error) {
+		return nixos.DeployWithContext(ctx, conn, target.NKey, req)
 	})
 }
+
+// follow starts a deployment on the agent with the given nkey using start, following its logs until it has finished
+// and returning the result.
+func follow(
+	ctx context.Context,
+	conn *nats.EncodedConn,
+	js nats.JetStreamContext,
+	nkey string,
+	output bool,
+	start func() (nixos.DeployResponse, error),
+) (result *nixos.DeployResult, err error) {
+	// subscribe to results before making the request so that we cannot miss it
+	var resultSub *nats.Subscription
+	if resultSub, err = conn.Conn.SubscribeSync(subject.AgentDeploymentResult(nkey, "*")); err != nil {
+		return
+	}
+	defer func() {
+		_ = resultSub.Unsubscribe()
+	}()
+
+	var resp nixos.DeployResponse
+	if resp, err = start(); err != nil {
+		return
+	} else if err = streamLogs(ctx, js, resp.Logs, output); err != nil {
+		return
+	}
+
+	return waitForResult(ctx, resultSub, resp.Id)
+}
+
+// buildClosure builds the given installable locally and returns the store path of the resulting system closure.
+func buildClosure(installable string) (path string, err error) {
+	var paths []string
+	if paths, err = buildClosures(installable); err != nil {
+		return
+	}
+	return paths[0], nil
+}
+
+// buildPath builds the given installable locally and returns the resulting store path, which need not be a NixOS
+// system closure.
+func buildPath(installable string) (path string, err error) {
+	var paths []string
+	if paths, err = build(installable); err != nil {
+		return
+	}
+	log.Infof("closure built successfully: %v", paths[0])
+	return paths[0], nil
+}
+
+// buildClosures builds the given installables locally in a single invocation of nix and returns the store paths of
+// the resulting system closures in the same order.
+func buildClosures(installables ...string) (paths []string, err error) {
+	if paths, err = build(installables...); err != nil {
+		return
+	}
+
+	for _, path := range paths {
+		log.Infof("closure built successfully: %v", path)
+
+		// validate the closure
+		closure, err := storepath.FromAbsolutePath(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to parse system closure", err)
+		} else if err = nix.IsSystemClosure(closure); err != nil {
+			return nil, fmt.Errorf("%w: invalid system closure %v", err, closure)
+		}
+	}
+
+	return
+}
+
+func build(installables ...string) (paths []string, err error) {
+	log.Infof("building closures: %v", installables)
+
+	args := append([]string{"build", "--no-link", "--refresh", "--print-out-paths"}, installables...)
+	cmd := exec.Command("nix", args...)
+	out, err := cmd.Output()
+	if err != nil {
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			_, _ = os.Stderr.Write(exit.Stderr)
+		}
+		return nil, fmt.Errorf("%w: failed to build closure", err)
+	}
+
+	paths = strings.Fields(string(out))
+	if len(paths) != len(installables) {
+		return nil, errors.Errorf("expected %d closures but nix returned %d", len(installables), len(paths))
+	}
+
+	return
+}
+
+// transfer uploads the closures of the given paths to the cache object store, returning the name of the bucket.
+func transfer(ctx context.Context, js nats.JetStreamContext, paths ...string) (bucket string, err error) {
+	var obs nats.ObjectStore
+	if obs, err = js.ObjectStore(cache.Bucket); err != nil {
+		return "", errors.Annotate(err, "failed to open cache object store")
+	}
+
+	log.Info("uploading closures", "bucket", cache.Bucket)
+
+	var uploaded int
+	if uploaded, err = cache.Upload(ctx, obs, paths...); err != nil {
+		return
+	}
+
+	log.Info("closures uploaded", "paths", uploaded)
+	return cache.Bucket, nil
+}
+
+// attach follows the logs of the deployment in progress on an agent and waits for its result.
+func attach(ctx context.Context, conn *nats.EncodedConn, js nats.JetStreamContext, target *info.Response, output bool) (err error) {
+	var status nixos.StatusResponse
+	if status, err = nixos.StatusWithContext(ctx, conn, target.NKey); err != nil {
+		return
+	} else if status.Deployment == nil {
+		return errors.New("no deployment is in progress")
+	}
+
+	deployment := status.Deployment
+	log.Info("attaching to deployment", "id", deployment.Id, "phase", deployment.Phase)
+
+	// the result is read from the deployments stream in case the deployment finishes before we are subscribed
+	var resultSub *nats.Subscription
+	if resultSub, err = js.SubscribeSync(deployment.Result, nats.DeliverAll(), nats.AckNone()); err != nil {
+		return
+	}
+	defer func() {
+		_ = resultSub.Unsubscribe()
+	}()
+
+	if err = streamLogs(ctx, js, deployment.Logs, output); err != nil {
+		return
+	}
+
+	var result *nixos.DeployResult
+	if result, err = waitForResult(ctx, resultSub, deployment.Id); err != nil {
+		return
+	}
+
+	return checkResult(target.Name, result)
+}
+
+// issuer identifies who is requesting a deployment using the local username and the name from their NATS claims.
+func issuer(claims *jwt.UserClaims) string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	if claims != nil && claims.Name != "" {
+		name = fmt.Sprintf("%s (%s)", name, claims.Name)
+	}
+	return name
+}
+
+// streamLogs writes the log records published to the given subject until an end of stream is encountered.
+func streamLogs(ctx context.Context, js nats.JetStreamContext, logs string, output bool) (err error) {
+	var sub *nats.Subscription
+	if sub, err = js.SubscribeSync(logs+".>", nats.DeliverAll(), nats.AckNone()); err != nil {
+		return
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	log.Debug("listening for logs", "subject", logs)
+	reader := nlog.RecordReader{Sub: sub, Context: ctx}
+
+	var record nlog.Record
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			record, err = reader.Read()
+			if errors.Is(err, nats.ErrTimeout) {
+				err = nil
+				continue
+			} else if nnats.IsEndOfStreamErr(err) {
+				err = nil
+				return
+			} else if err != nil {
+				return
+			}
+
+			if !output && record.Type() == nlog.RecordTerm {
+				continue
+			}
+
+			_, _ = record.Write(os.Stderr)
+		}
+	}
+}
+
+// waitForResult reads from a subscription to deployment results until the result for the given deployment id arrives.
+func waitForResult(ctx context.Context, sub *nats.Subscription, id string) (result *nixos.DeployResult, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var msg *nats.Msg
+	for {
+		if msg, err = sub.NextMsgWithContext(ctx); err != nil {
+			return nil, errors.Annotate(err, "failed to receive deployment result")
+		}
+
+		result = &nixos.DeployResult{}
+		if err = json.Unmarshal(msg.Data, result); err != nil {
+			return nil, errors.Annotate(err, "failed to unmarshal deployment result")
+		} else if result.Id == id {
+			return
+		}
+	}
+}
+
+func checkResult(name string, result *nixos.DeployResult) error {
+	if report := result.Activation; report != nil && len(report.Failed) > 0 {
+		log.Warn("units failed after activation", "name", name, "units", formatUnits(report.Failed))
+	}
+
+	if !result.Success {
+		if result.RolledBack {
+			log.Warn("system was rolled back", "name", name, "system", result.NewSystem)
+		} else if result.RollbackError != "" {
+			log.Error("failed to roll back system", "name", name, "error", result.RollbackError)
+		}
+		return errors.Errorf(
+			"deployment %s to %s failed whilst %s: %s",
+			result.Id, name, strcase.ToCase(result.Phase.String(), strcase.LowerCase, ' '), result.Error,
+		)
+	}
+
+	log.Info("deployment succeeded",
+		"name", name,
+		"id", result.Id,
+		"duration", result.Duration,
+		"previous", result.PreviousSystem,
+		"new", result.NewSystem,
+	)
+
+	if activation := result.DryActivation; activation != nil {
+		log.Info("dry activation",
+			"name", name,
+			"stop", formatUnits(activation.Units.Stop),
+			"start", formatUnits(activation.Units.Start),
+			"restart", formatUnits(activation.Units.Restart),
+			"reload", formatUnits(activation.Units.Reload),
+			"reboot-required", activation.RebootRequired,
+		)
+	}
+
+	return nil
+}
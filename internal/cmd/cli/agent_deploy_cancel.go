@@ -0,0 +1,56 @@
+package cli
+
+import (
+	"context"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/nats-io/nats.go"
+	"github.com/numtide/nits/internal/cmd"
+	"github.com/numtide/nits/pkg/agent"
+	"github.com/numtide/nits/pkg/agent/nixos"
+	nnats "github.com/numtide/nits/pkg/nats"
+)
+
+type agentDeployCancel struct {
+	Nats nnats.CliOptions `embed:"" prefix:"nats-"`
+
+	Name string `required:"" help:"the name given to the agent"`
+	Id   string `arg:"" optional:"" help:"id of the deployment to cancel, defaults to whichever deployment is in progress"`
+}
+
+func (c *agentDeployCancel) Run() error {
+	if err := Cmd.Log.ConfigureLog(); err != nil {
+		return err
+	}
+
+	return cmd.Run(func(ctx context.Context) (err error) {
+		var (
+			conn    *nats.Conn
+			encoded *nats.EncodedConn
+			nkey    string
+		)
+
+		if conn, err = c.Nats.Connect(); err != nil {
+			return
+		} else if encoded, err = nats.NewEncodedConn(conn, nats.JSON_ENCODER); err != nil {
+			return
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		if nkey, err = agent.ResolveNKey(ctx, conn, c.Name); err != nil {
+			return
+		}
+
+		var resp nixos.CancelResponse
+		if resp, err = nixos.CancelWithContext(ctx, encoded, nkey, nixos.CancelRequest{Id: c.Id}); err != nil {
+			return
+		}
+
+		log.Info("deployment cancelled", "name", c.Name, "id", resp.Id)
+		return
+	})
+}
@@ -0,0 +1,159 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+	"github.com/numtide/nits/pkg/agent/info"
+	"github.com/numtide/nits/pkg/agent/nixos"
+	"github.com/numtide/nits/pkg/nix"
+)
+
+// planTimeout bounds how long an agent may take to realise a closure and dry activate it.
+const planTimeout = 30 * time.Minute
+
+type agentPlan struct {
+	target   *info.Response
+	closure  string
+	response *nixos.PlanResponse
+	err      error
+}
+
+// plan asks each target to plan its deployment, prints a summary of the changes and asks the user whether to proceed.
+func plan(
+	ctx context.Context,
+	conn *nats.EncodedConn,
+	targets []*info.Response,
+	requests map[string]nixos.DeployRequest,
+) (proceed bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, planTimeout)
+	defer cancel()
+
+	plans := make([]agentPlan, len(targets))
+
+	var wg sync.WaitGroup
+	for idx, target := range targets {
+		plans[idx] = agentPlan{target: target, closure: requests[target.NKey].Closure}
+
+		wg.Add(1)
+		go func(p *agentPlan) {
+			defer wg.Done()
+			p.response, p.err = planFor(ctx, conn, p.target, requests[p.target.NKey])
+		}(&plans[idx])
+	}
+
+	log.Info("planning deployment", "agents", len(targets))
+	wg.Wait()
+
+	var failed int
+	for _, p := range plans {
+		printPlan(p)
+		if p.err != nil {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return false, errors.Errorf("failed to plan the deployment to %d agent(s)", failed)
+	}
+
+	print("Proceed with the deployment? [y/N] ")
+
+	var answer string
+	if answer, err = bufio.NewReader(os.Stdin).ReadString('\n'); err != nil {
+		return false, errors.Annotate(err, "failed to read confirmation")
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// planFor plans the deployment for a single target, returning nil if it is already running the closure.
+func planFor(ctx context.Context, conn *nats.EncodedConn, target *info.Response, req nixos.DeployRequest) (*nixos.PlanResponse, error) {
+	var agentInfo info.Response
+	if err := info.GetWithContext(ctx, conn, target.NKey, info.Request{NixOS: true}, &agentInfo); err != nil {
+		return nil, errors.Annotate(err, "failed to retrieve agent info")
+	} else if agentInfo.NixOS == nil {
+		return nil, errors.New("agent is not running NixOS")
+	} else if agentInfo.NixOS.CurrentSystem == req.Closure {
+		return nil, nil
+	}
+
+	resp, err := nixos.PlanWithContext(ctx, conn, target.NKey, nixos.PlanRequest{
+		Closure: req.Closure,
+		Cache:   req.Cache,
+	})
+	return &resp, err
+}
+
+func printPlan(p agentPlan) {
+	println(sectionHeaderStyle.Render(p.target.Name + ":"))
+	println()
+
+	kvPrintln("New system:", p.closure)
+
+	if p.err != nil {
+		kvPrintln("Error:", p.err.Error())
+		println()
+		return
+	} else if p.response == nil {
+		kvPrintln("Changes:", "none, the agent is already running this system")
+		println()
+		return
+	}
+
+	kvPrintln("Current system:", p.response.CurrentSystem)
+	println()
+
+	if len(p.response.Packages) == 0 {
+		kvPrintln("Packages:", "no version changes")
+	}
+	for _, change := range p.response.Packages {
+		kvPrintln(change.Name+":", fmt.Sprintf("%s → %s", formatVersions(change.Before), formatVersions(change.After)))
+	}
+	println()
+
+	printDryActivation(p.response.Activation)
+	println()
+}
+
+func printDryActivation(activation nix.DryActivation) {
+	units := activation.Units
+	kvPrintln("Units to stop:", formatUnits(units.Stop))
+	kvPrintln("Units to start:", formatUnits(units.Start))
+	kvPrintln("Units to restart:", formatUnits(units.Restart))
+	kvPrintln("Units to reload:", formatUnits(units.Reload))
+	kvPrintln("Reboot required:", strconv.FormatBool(activation.RebootRequired))
+}
+
+// formatVersions renders a set of versions using the same notation as nix store diff-closures.
+func formatVersions(versions []string) string {
+	if len(versions) == 0 {
+		return "∅"
+	}
+
+	formatted := make([]string, len(versions))
+	for idx, version := range versions {
+		if version == "" {
+			version = "ε"
+		}
+		formatted[idx] = version
+	}
+	return strings.Join(formatted, ", ")
+}
+
+func formatUnits(units []string) string {
+	if len(units) == 0 {
+		return "none"
+	}
+	return strings.Join(units, ", ")
+}
@@ -0,0 +1,151 @@
+package cli
+
+import (
+	"context"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+	"github.com/numtide/nits/pkg/agent/info"
+	"github.com/numtide/nits/pkg/agent/nixos"
+)
+
+// rolloutOptions control how a deployment to multiple agents is carried out.
+type rolloutOptions struct {
+	BatchSize   int `default:"1" help:"number of agents to deploy to at the same time during a rolling deployment"`
+	Canary      int `default:"0" help:"number of agents to deploy to first, any failure amongst them stops the rollout"`
+	MaxFailures int `default:"0" help:"number of failed deployments to tolerate before stopping the rollout"`
+}
+
+func (r *rolloutOptions) validate() error {
+	if r.BatchSize < 1 {
+		return errors.New("--batch-size must be at least 1")
+	} else if r.Canary < 0 {
+		return errors.New("--canary cannot be negative")
+	} else if r.MaxFailures < 0 {
+		return errors.New("--max-failures cannot be negative")
+	}
+	return nil
+}
+
+// uniqueTargets removes any agent which appears more than once, so that no agent is deployed to twice.
+func uniqueTargets(targets []*info.Response) []*info.Response {
+	seen := make(map[string]bool, len(targets))
+	result := make([]*info.Response, 0, len(targets))
+	for _, target := range targets {
+		if seen[target.NKey] {
+			continue
+		}
+		seen[target.NKey] = true
+		result = append(result, target)
+	}
+	return result
+}
+
+// rollout deploys to the targets in batches, starting with any canaries. Each batch must finish before the next one
+// begins, and the rollout is stopped if a canary fails or the number of failures exceeds the configured maximum.
+// The request for each target is looked up by its NKey.
+func (r *rolloutOptions) rollout(
+	ctx context.Context,
+	conn *nats.EncodedConn,
+	js nats.JetStreamContext,
+	targets []*info.Response,
+	requests map[string]nixos.DeployRequest,
+	output bool,
+) error {
+	var failed []string
+
+	targets = uniqueTargets(targets)
+	batches := batch(targets, r.Canary, r.BatchSize)
+
+	for idx, b := range batches {
+		canary := idx == 0 && r.Canary > 0
+
+		log.Info("deploying batch", "batch", idx+1, "batches", len(batches), "agents", names(b), "canary", canary)
+
+		for name, err := range deployBatch(ctx, conn, js, b, requests, output) {
+			if err != nil {
+				log.Error("deployment failed", "name", name, "error", err)
+				failed = append(failed, name)
+			}
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		} else if canary && len(failed) > 0 {
+			return errors.Errorf("rollout stopped, canary deployments failed: %v", failed)
+		} else if len(failed) > r.MaxFailures {
+			return errors.Errorf("rollout stopped after %d failed deployments: %v", len(failed), failed)
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.Errorf("rollout completed with %d failed deployments: %v", len(failed), failed)
+	}
+
+	log.Info("rollout complete", "agents", len(targets))
+	return nil
+}
+
+// deployBatch deploys to each target in parallel and returns the outcome for each agent by name.
+func deployBatch(
+	ctx context.Context,
+	conn *nats.EncodedConn,
+	js nats.JetStreamContext,
+	targets []*info.Response,
+	requests map[string]nixos.DeployRequest,
+	output bool,
+) map[string]error {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make(map[string]error, len(targets))
+	)
+
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target *info.Response) {
+			defer wg.Done()
+
+			result, err := deployTo(ctx, conn, js, target, requests[target.NKey], output)
+			if err == nil {
+				err = checkResult(target.Name, result)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[target.Name] = err
+		}(target)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// batch splits the targets into a batch of canaries followed by batches of the given size.
+func batch(targets []*info.Response, canaries int, size int) (batches [][]*info.Response) {
+	if canaries > len(targets) {
+		canaries = len(targets)
+	}
+
+	if canaries > 0 {
+		batches = append(batches, targets[:canaries])
+		targets = targets[canaries:]
+	}
+
+	for len(targets) > 0 {
+		n := min(size, len(targets))
+		batches = append(batches, targets[:n])
+		targets = targets[n:]
+	}
+
+	return
+}
+
+func names(agents []*info.Response) (result []string) {
+	for _, a := range agents {
+		result = append(result, a.Name)
+	}
+	return
+}
@@ -0,0 +1,229 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/table"
+	"github.com/ettle/strcase"
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+	"github.com/numtide/nits/internal/cmd"
+	"github.com/numtide/nits/pkg/agent"
+	"github.com/numtide/nits/pkg/agent/info"
+	"github.com/numtide/nits/pkg/agent/nixos"
+	nutil "github.com/numtide/nits/pkg/nats"
+	"github.com/xeonx/timeago"
+)
+
+type agentDeployments struct {
+	Nats nutil.CliOptions `embed:"" prefix:"nats-"`
+
+	Id   string `help:"Show the details of a specific deployment"`
+	Name string `arg:"" optional:"" help:"Only show deployments for the agent with this name"`
+}
+
+func (c *agentDeployments) Run() error {
+	if err := Cmd.Log.ConfigureLog(); err != nil {
+		return err
+	}
+
+	return cmd.Run(func(ctx context.Context) (err error) {
+		var (
+			conn *nats.Conn
+			js   nats.JetStreamContext
+		)
+
+		if conn, err = c.Nats.Connect(); err != nil {
+			return
+		} else if js, err = conn.JetStream(); err != nil {
+			return
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		var (
+			agents         []*info.Response
+			byName, byNKey map[string]*info.Response
+		)
+
+		if agents, err = agent.List(ctx, conn); err != nil {
+			return
+		} else if byName, err = agent.IndexByName(agents); err != nil {
+			return
+		} else if byNKey, err = agent.IndexByNKey(agents); err != nil {
+			return
+		}
+
+		var nkey string
+		if c.Name != "" {
+			if agentInfo, ok := byName[c.Name]; ok {
+				nkey = agentInfo.NKey
+			} else {
+				return errors.Errorf("could not find an agent with name = %s", c.Name)
+			}
+		}
+
+		var deployments []*nixos.Deployment
+		if deployments, err = nixos.History(ctx, js, nkey); err != nil {
+			return
+		}
+
+		if c.Id != "" {
+			var deployment *nixos.Deployment
+			if deployment, err = nixos.FindDeployment(deployments, c.Id); err != nil {
+				return
+			}
+			printDeployment(deployment, byNKey)
+			return
+		}
+
+		columns := []table.Column{
+			{Title: "Id", Width: 22},
+			{Title: "Agent", Width: 24},
+			{Title: "Started", Width: 20},
+			{Title: "Action", Width: 12},
+			{Title: "Status", Width: 32},
+			{Title: "Units", Width: 40},
+			{Title: "Issuer", Width: 24},
+			{Title: "Closure", Width: 80},
+		}
+
+		var rows []table.Row
+		for _, d := range deployments {
+			var action, closure, issuer string
+			if d.Request != nil {
+				action = strcase.ToKebab(d.Request.Action.String())
+				closure = d.Request.Closure
+				issuer = d.Request.Issuer
+			}
+			row := table.Row{
+				d.Id,
+				agentName(d.NKey, byNKey),
+				timeago.English.Format(d.Started),
+				action,
+				deploymentStatus(d),
+				activationSummary(d),
+				issuer,
+				closure,
+			}
+			rows = append(rows, row)
+		}
+
+		t := table.New(
+			table.WithColumns(columns),
+			table.WithRows(rows),
+			table.WithFocused(false),
+			table.WithHeight(len(rows)),
+		)
+
+		t.SetStyles(tableStyle)
+
+		println(t.View())
+
+		return
+	})
+}
+
+func agentName(nkey string, byNKey map[string]*info.Response) string {
+	if agentInfo, ok := byNKey[nkey]; ok {
+		return agentInfo.Name
+	}
+	return nkey
+}
+
+func deploymentStatus(d *nixos.Deployment) string {
+	if d.Result == nil {
+		return "in progress"
+	} else if d.Result.Success {
+		return fmt.Sprintf("succeeded in %v", d.Result.Duration.Round(time.Second))
+	}
+	status := fmt.Sprintf("failed whilst %s", strcase.ToCase(d.Result.Phase.String(), strcase.LowerCase, ' '))
+	if d.Result.RolledBack {
+		status += ", rolled back"
+	}
+	return status
+}
+
+// activationSummary counts the units affected by a deployment's activation e.g. "3 restarted, 1 failed".
+func activationSummary(d *nixos.Deployment) string {
+	if d.Result == nil || d.Result.Activation == nil {
+		return ""
+	}
+
+	report := d.Result.Activation
+
+	var summary []string
+	for _, count := range []struct {
+		verb  string
+		units []string
+	}{
+		{"stopped", report.Units.Stop},
+		{"started", report.Units.Start},
+		{"restarted", report.Units.Restart},
+		{"reloaded", report.Units.Reload},
+		{"failed", report.Failed},
+	} {
+		if len(count.units) > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", len(count.units), count.verb))
+		}
+	}
+
+	if len(summary) == 0 {
+		return "no changes"
+	}
+	return strings.Join(summary, ", ")
+}
+
+func printDeployment(d *nixos.Deployment, byNKey map[string]*info.Response) {
+	println(sectionHeaderStyle.Render(fmt.Sprintf("Deployment %s:", d.Id)))
+	println()
+	kvPrintln("Agent:", agentName(d.NKey, byNKey))
+	kvPrintln("NKey:", d.NKey)
+	kvPrintln("Status:", deploymentStatus(d))
+
+	if d.Request != nil {
+		kvPrintln("Started:", d.Started.Format(time.RFC1123Z))
+		kvPrintln("Issuer:", d.Request.Issuer)
+		kvPrintln("Action:", strcase.ToKebab(d.Request.Action.String()))
+		kvPrintln("Closure:", d.Request.Closure)
+		if d.Request.Profile != "" {
+			kvPrintln("Profile:", d.Request.Profile)
+		}
+		if d.Request.Activate != "" {
+			kvPrintln("Activation script:", d.Request.Activate)
+			kvPrintln("User:", d.Request.User)
+		}
+	}
+
+	if d.Result != nil {
+		kvPrintln("Finished:", d.Finished.Format(time.RFC1123Z))
+		kvPrintln("Duration:", d.Result.Duration.String())
+		kvPrintln("Previous system:", d.Result.PreviousSystem)
+		kvPrintln("New system:", d.Result.NewSystem)
+		if d.Result.Error != "" {
+			kvPrintln("Error:", d.Result.Error)
+		}
+		kvPrintln("Confirmed:", strconv.FormatBool(d.Result.Confirmed))
+		kvPrintln("Rolled back:", strconv.FormatBool(d.Result.RolledBack))
+		if d.Result.RollbackError != "" {
+			kvPrintln("Rollback error:", d.Result.RollbackError)
+		}
+		if d.Result.DryActivation != nil {
+			printDryActivation(*d.Result.DryActivation)
+		}
+		if report := d.Result.Activation; report != nil {
+			kvPrintln("Units stopped:", formatUnits(report.Units.Stop))
+			kvPrintln("Units started:", formatUnits(report.Units.Start))
+			kvPrintln("Units restarted:", formatUnits(report.Units.Restart))
+			kvPrintln("Units reloaded:", formatUnits(report.Units.Reload))
+			kvPrintln("Units failed:", formatUnits(report.Failed))
+			kvPrintln("Exit status:", strconv.Itoa(report.ExitStatus))
+		}
+	}
+}
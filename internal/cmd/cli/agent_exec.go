@@ -0,0 +1,145 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+	"github.com/numtide/nits/internal/cmd"
+	"github.com/numtide/nits/pkg/agent"
+	"github.com/numtide/nits/pkg/agent/exec"
+	nnats "github.com/numtide/nits/pkg/nats"
+	"github.com/numtide/nits/pkg/subject"
+)
+
+type agentExec struct {
+	Nats nnats.CliOptions `embed:"" prefix:"nats-"`
+
+	Name    string   `arg:"" help:"the name given to the agent"`
+	Command []string `arg:"" passthrough:"" help:"the command to run followed by its arguments, after --"`
+}
+
+func (c *agentExec) Run() error {
+	if err := Cmd.Log.ConfigureLog(); err != nil {
+		return err
+	}
+
+	return cmd.Run(func(ctx context.Context) (err error) {
+		var (
+			opts    []nats.Option
+			js      nats.JetStreamContext
+			conn    *nats.Conn
+			encoded *nats.EncodedConn
+			nkey    string
+		)
+
+		if opts, _, _, err = c.Nats.ToNatsOptions(); err != nil {
+			return
+		} else if conn, err = nats.Connect(c.Nats.Url, opts...); err != nil {
+			return
+		} else if encoded, err = nats.NewEncodedConn(conn, nats.JSON_ENCODER); err != nil {
+			return
+		} else if js, err = conn.JetStream(); err != nil {
+			return
+		}
+
+		resolveCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		if nkey, err = agent.ResolveNKey(resolveCtx, conn, c.Name); err != nil {
+			return
+		}
+
+		req := exec.Request{
+			Command: c.Command,
+		}
+
+		// subscribe to the result before making the request so that we cannot miss it, we only learn its id from the
+		// response
+		var resultSub *nats.Subscription
+		if resultSub, err = conn.SubscribeSync(subject.AgentExecResult(nkey, "*")); err != nil {
+			return
+		}
+		defer func() {
+			_ = resultSub.Unsubscribe()
+		}()
+
+		var resp exec.Response
+		if resp, err = exec.ExecWithContext(ctx, encoded, nkey, req); err != nil {
+			return
+		} else if err = streamOutput(ctx, js, resp.Logs); err != nil {
+			return
+		}
+
+		resultCtx, cancelResult := context.WithTimeout(ctx, 30*time.Second)
+		defer cancelResult()
+
+		var msg *nats.Msg
+		for msg == nil || msg.Subject != subject.AgentExecResult(nkey, resp.Id) {
+			if msg, err = resultSub.NextMsgWithContext(resultCtx); err != nil {
+				return errors.Annotate(err, "failed to receive exec result")
+			}
+		}
+
+		var result exec.Result
+		if err = json.Unmarshal(msg.Data, &result); err != nil {
+			return errors.Annotate(err, "failed to unmarshal exec result")
+		} else if result.Error != "" {
+			return errors.Errorf("failed to run command on %s: %s", c.Name, result.Error)
+		}
+
+		log.Debug("command exited", "name", c.Name, "exit-code", result.ExitCode, "duration", result.Duration)
+
+		// exit with the same status as the command, as ssh would
+		if result.ExitCode != 0 {
+			return cmd.ExitError{Code: result.ExitCode}
+		}
+		return
+	})
+}
+
+// streamOutput copies the stdout and stderr of a command run by an agent to our own, until both have ended.
+func streamOutput(ctx context.Context, js nats.JetStreamContext, logs string) (err error) {
+	var sub *nats.Subscription
+	if sub, err = js.SubscribeSync(logs+".>", nats.DeliverAll(), nats.AckNone()); err != nil {
+		return
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	// the agent ends each of the sys, stdout and stderr subjects
+	open := 3
+
+	var (
+		msg   *nats.Msg
+		isEOS bool
+	)
+
+	for open > 0 {
+		if msg, err = sub.NextMsgWithContext(ctx); err != nil {
+			return
+		} else if isEOS, err = nnats.IsEndOfStream(msg); err != nil {
+			return
+		} else if isEOS {
+			open--
+			continue
+		}
+
+		switch {
+		case strings.HasSuffix(msg.Subject, ".STDOUT"):
+			_, _ = os.Stdout.Write(msg.Data)
+		case strings.HasSuffix(msg.Subject, ".STDERR"):
+			_, _ = os.Stderr.Write(msg.Data)
+		default:
+			log.Debug("agent log", "subject", msg.Subject, "msg", strings.TrimSpace(string(msg.Data)))
+		}
+	}
+
+	return
+}
@@ -0,0 +1,138 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/dustin/go-humanize"
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+	"github.com/numtide/nits/internal/cmd"
+	"github.com/numtide/nits/pkg/agent"
+	"github.com/numtide/nits/pkg/agent/info"
+	"github.com/numtide/nits/pkg/agent/nixos"
+	nlog "github.com/numtide/nits/pkg/logging"
+	nnats "github.com/numtide/nits/pkg/nats"
+	"github.com/numtide/nits/pkg/subject"
+)
+
+type agentGc struct {
+	Nats nnats.CliOptions `embed:"" prefix:"nats-"`
+
+	Name string `arg:"" help:"the name given to the agent"`
+
+	MaxFreed        string `help:"stop once this much space has been freed e.g. 10GiB"`
+	MinFree         string `help:"stop once the file system holding the nix store has this much free space e.g. 20GiB"`
+	KeepGenerations int    `help:"delete all but this many of the most recent system generations beforehand"`
+
+	Output bool `help:"output agent's stdout and stderr"`
+}
+
+func (c *agentGc) Run() error {
+	if err := Cmd.Log.ConfigureLog(); err != nil {
+		return err
+	}
+
+	req := nixos.GcRequest{KeepGenerations: c.KeepGenerations}
+
+	var err error
+	if c.MaxFreed != "" {
+		if req.MaxFreed, err = humanize.ParseBytes(c.MaxFreed); err != nil {
+			return errors.Annotate(err, "malformed --max-freed")
+		}
+	}
+	if c.MinFree != "" {
+		if req.MinFree, err = humanize.ParseBytes(c.MinFree); err != nil {
+			return errors.Annotate(err, "malformed --min-free")
+		}
+	}
+
+	return cmd.Run(func(ctx context.Context) (err error) {
+		var (
+			opts    []nats.Option
+			js      nats.JetStreamContext
+			conn    *nats.Conn
+			encoded *nats.EncodedConn
+		)
+
+		if opts, _, _, err = c.Nats.ToNatsOptions(); err != nil {
+			return
+		} else if conn, err = nats.Connect(c.Nats.Url, opts...); err != nil {
+			return
+		} else if encoded, err = nats.NewEncodedConn(conn, nats.JSON_ENCODER); err != nil {
+			return
+		} else if js, err = conn.JetStream(); err != nil {
+			return
+		}
+
+		listCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		var (
+			agents         []*info.Response
+			byName, byNKey map[string]*info.Response
+		)
+
+		if agents, err = agent.List(listCtx, conn); err != nil {
+			return
+		} else if byName, err = agent.IndexByName(agents); err != nil {
+			return
+		} else if byNKey, err = agent.IndexByNKey(agents); err != nil {
+			return
+		}
+
+		target, ok := byName[c.Name]
+		if !ok {
+			return errors.Errorf("could not find an agent named %s", c.Name)
+		}
+
+		// set agent indices in the context for the log writer
+		ctx = nlog.SetAgentsByName(ctx, byName)
+		ctx = nlog.SetAgentsByNKey(ctx, byNKey)
+
+		// subscribe to the result before making the request so that we cannot miss it, we only learn its id from the
+		// response
+		var resultSub *nats.Subscription
+		if resultSub, err = conn.SubscribeSync(subject.AgentGcResult(target.NKey, "*")); err != nil {
+			return
+		}
+		defer func() {
+			_ = resultSub.Unsubscribe()
+		}()
+
+		var resp nixos.GcResponse
+		if resp, err = nixos.GcWithContext(ctx, encoded, target.NKey, req); err != nil {
+			return
+		} else if err = streamLogs(ctx, js, resp.Logs, c.Output); err != nil {
+			return
+		}
+
+		resultCtx, cancelResult := context.WithTimeout(ctx, 30*time.Second)
+		defer cancelResult()
+
+		var msg *nats.Msg
+		for msg == nil || msg.Subject != subject.AgentGcResult(target.NKey, resp.Id) {
+			if msg, err = resultSub.NextMsgWithContext(resultCtx); err != nil {
+				return errors.Annotate(err, "failed to receive garbage collection result")
+			}
+		}
+
+		var result nixos.GcResult
+		if err = json.Unmarshal(msg.Data, &result); err != nil {
+			return errors.Annotate(err, "failed to unmarshal garbage collection result")
+		} else if !result.Success {
+			return errors.Errorf("garbage collection on %s failed: %s", target.Name, result.Error)
+		}
+
+		log.Info("garbage collection succeeded",
+			"name", target.Name,
+			"duration", result.Duration,
+			"freed", humanize.IBytes(result.FreeAfter-min(result.FreeBefore, result.FreeAfter)),
+			"free", humanize.IBytes(result.FreeAfter),
+			"deleted-generations", len(result.DeletedGenerations),
+		)
+		return
+	})
+}
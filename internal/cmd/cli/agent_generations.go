@@ -0,0 +1,222 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/table"
+	"github.com/charmbracelet/log"
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+	"github.com/numtide/nits/internal/cmd"
+	"github.com/numtide/nits/pkg/agent"
+	"github.com/numtide/nits/pkg/agent/info"
+	"github.com/numtide/nits/pkg/agent/nixos"
+	nlog "github.com/numtide/nits/pkg/logging"
+	nnats "github.com/numtide/nits/pkg/nats"
+	"github.com/xeonx/timeago"
+)
+
+type agentGenerationsList struct {
+	Nats nnats.CliOptions `embed:"" prefix:"nats-"`
+
+	Name string `arg:"" help:"the name given to the agent"`
+}
+
+func (c *agentGenerationsList) Run() error {
+	if err := Cmd.Log.ConfigureLog(); err != nil {
+		return err
+	}
+
+	return cmd.Run(func(ctx context.Context) (err error) {
+		var (
+			conn    *nats.Conn
+			encoded *nats.EncodedConn
+			nkey    string
+			resp    nixos.GenerationsResponse
+		)
+
+		if conn, err = c.Nats.Connect(); err != nil {
+			return
+		} else if encoded, err = nats.NewEncodedConn(conn, nats.JSON_ENCODER); err != nil {
+			return
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		if nkey, err = agent.ResolveNKey(ctx, conn, c.Name); err != nil {
+			return
+		} else if resp, err = nixos.GenerationsWithContext(ctx, encoded, nkey); err != nil {
+			return
+		}
+
+		columns := []table.Column{
+			{Title: "Generation", Width: 12},
+			{Title: "Date", Width: 20},
+			{Title: "Created", Width: 20},
+			{Title: "Status", Width: 16},
+			{Title: "Path", Width: 80},
+		}
+
+		var rows []table.Row
+		for _, gen := range resp.Generations {
+			var status []string
+			if gen.Current {
+				status = append(status, "current")
+			}
+			if gen.Booted {
+				status = append(status, "booted")
+			}
+
+			rows = append(rows, table.Row{
+				strconv.Itoa(gen.Number),
+				gen.Date.Format(time.DateTime),
+				timeago.English.Format(gen.Date),
+				strings.Join(status, ", "),
+				gen.Path,
+			})
+		}
+
+		t := table.New(
+			table.WithColumns(columns),
+			table.WithRows(rows),
+			table.WithFocused(false),
+			table.WithHeight(len(rows)),
+		)
+
+		t.SetStyles(tableStyle)
+
+		println(t.View())
+
+		return
+	})
+}
+
+type agentGenerationsRollback struct {
+	Nats nnats.CliOptions `embed:"" prefix:"nats-"`
+
+	Name       string `arg:"" help:"the name given to the agent"`
+	Generation int    `arg:"" optional:"" help:"the generation to switch to, defaults to the one before the current generation"`
+
+	Output bool `help:"output agent's stdout and stderr"`
+	Force  bool `help:"activate immediately instead of waiting for the agent's maintenance window"`
+}
+
+func (c *agentGenerationsRollback) Run() error {
+	if err := Cmd.Log.ConfigureLog(); err != nil {
+		return err
+	}
+
+	return cmd.Run(func(ctx context.Context) (err error) {
+		var (
+			opts    []nats.Option
+			js      nats.JetStreamContext
+			conn    *nats.Conn
+			encoded *nats.EncodedConn
+		)
+
+		if opts, _, _, err = c.Nats.ToNatsOptions(); err != nil {
+			return
+		} else if conn, err = nats.Connect(c.Nats.Url, opts...); err != nil {
+			return
+		} else if encoded, err = nats.NewEncodedConn(conn, nats.JSON_ENCODER); err != nil {
+			return
+		} else if js, err = conn.JetStream(); err != nil {
+			return
+		}
+
+		listCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		var (
+			agents         []*info.Response
+			byName, byNKey map[string]*info.Response
+		)
+
+		if agents, err = agent.List(listCtx, conn); err != nil {
+			return
+		} else if byName, err = agent.IndexByName(agents); err != nil {
+			return
+		} else if byNKey, err = agent.IndexByNKey(agents); err != nil {
+			return
+		}
+
+		target, ok := byName[c.Name]
+		if !ok {
+			return errors.Errorf("could not find an agent named %s", c.Name)
+		}
+
+		// set agent indices in the context for the log writer
+		ctx = nlog.SetAgentsByName(ctx, byName)
+		ctx = nlog.SetAgentsByNKey(ctx, byNKey)
+
+		req := nixos.RollbackRequest{
+			Generation: c.Generation,
+			Force:      c.Force,
+		}
+
+		var result *nixos.DeployResult
+		if result, err = follow(ctx, encoded, js, target.NKey, c.Output, func() (nixos.DeployResponse, error) {
+			return nixos.RollbackWithContext(ctx, encoded, target.NKey, req)
+		}); err != nil {
+			return
+		}
+
+		return checkResult(target.Name, result)
+	})
+}
+
+type agentGenerationsDelete struct {
+	Nats nnats.CliOptions `embed:"" prefix:"nats-"`
+
+	Name      string `arg:"" help:"the name given to the agent"`
+	Keep      int    `xor:"criteria" required:"" help:"delete all but this many of the most recent generations"`
+	OlderThan string `xor:"criteria" required:"" help:"delete generations older than this many days e.g. 30d"`
+}
+
+func (c *agentGenerationsDelete) Run() error {
+	if err := Cmd.Log.ConfigureLog(); err != nil {
+		return err
+	}
+
+	return cmd.Run(func(ctx context.Context) (err error) {
+		var (
+			conn    *nats.Conn
+			encoded *nats.EncodedConn
+			nkey    string
+			resp    nixos.DeleteGenerationsResponse
+		)
+
+		if conn, err = c.Nats.Connect(); err != nil {
+			return
+		} else if encoded, err = nats.NewEncodedConn(conn, nats.JSON_ENCODER); err != nil {
+			return
+		}
+
+		var cancel context.CancelFunc
+		// updating the boot loader can take a while
+		ctx, cancel = context.WithTimeout(ctx, time.Minute)
+		defer cancel()
+
+		req := nixos.DeleteGenerationsRequest{Keep: c.Keep, OlderThan: c.OlderThan}
+
+		if nkey, err = agent.ResolveNKey(ctx, conn, c.Name); err != nil {
+			return
+		} else if resp, err = nixos.DeleteGenerationsWithContext(ctx, encoded, nkey, req); err != nil {
+			return
+		}
+
+		if len(resp.Deleted) == 0 {
+			log.Info("no generations were deleted", "name", c.Name)
+			return
+		}
+
+		log.Info("generations deleted", "name", c.Name, "generations", fmt.Sprint(resp.Deleted))
+		return
+	})
+}
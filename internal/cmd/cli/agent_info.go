@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/charmbracelet/log"
 	"github.com/juju/errors"
 	"github.com/nats-io/nats.go"
 	"github.com/numtide/nits/internal/cmd"
@@ -16,8 +17,9 @@ import (
 )
 
 type agentInfo struct {
-	Nats nutil.CliOptions `embed:"" prefix:"nats-"`
-	Name string           `arg:""`
+	Nats     nutil.CliOptions `embed:"" prefix:"nats-"`
+	Name     string           `arg:"" optional:""`
+	Selector string           `help:"Show info for every agent whose labels match the selector e.g. site=oslo,role=gateway"`
 
 	All   bool `help:"Include all available agent info"`
 	Host  bool `help:"Include information about the host machine"`
@@ -31,6 +33,10 @@ func (c *agentInfo) Run() error {
 		return err
 	}
 
+	if (c.Name == "") == (c.Selector == "") {
+		return errors.New("either a name or --selector must be specified")
+	}
+
 	return cmd.Run(func(ctx context.Context) (err error) {
 		var (
 			conn    *nats.Conn
@@ -47,25 +53,45 @@ func (c *agentInfo) Run() error {
 		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
 		defer cancel()
 
-		var agents []*info.Response
-		if agents, err = agent.List(ctx, conn); err != nil {
+		var (
+			agents   []*info.Response
+			selector agent.Selector
+		)
+
+		if selector, err = agent.ParseSelector(c.Selector); err != nil {
+			return
+		} else if agents, err = agent.List(ctx, conn); err != nil {
 			return err
 		}
 
-		var nkey string
-		for _, a := range agents {
-			if a.Name == c.Name {
-				elapsed := time.Now().Sub(a.LastSeen)
-				if elapsed > 10*time.Second {
-					return errors.Errorf("agent has not been seen in %v", elapsed)
+		var targets []*info.Response
+		if c.Name != "" {
+			for _, a := range agents {
+				if a.Name == c.Name {
+					elapsed := time.Now().Sub(a.LastSeen)
+					if elapsed > 10*time.Second {
+						return errors.Errorf("agent has not been seen in %v", elapsed)
+					}
+					targets = append(targets, a)
+					break
 				}
-				nkey = a.NKey
-				break
 			}
-		}
 
-		if nkey == "" {
-			return errors.Errorf("no agent with the name '%s' has ever reported in", c.Name)
+			if len(targets) == 0 {
+				return errors.Errorf("no agent with the name '%s' has ever reported in", c.Name)
+			}
+		} else {
+			for _, a := range agent.Select(agents, selector) {
+				if elapsed := time.Now().Sub(a.LastSeen); elapsed > 10*time.Second {
+					log.Warn("skipping agent", "name", a.Name, "reason", fmt.Sprintf("not seen in %v", elapsed))
+					continue
+				}
+				targets = append(targets, a)
+			}
+
+			if len(targets) == 0 {
+				return errors.Errorf("no agents match the selector '%s'", c.Selector)
+			}
 		}
 
 		req := info.Request{
@@ -75,16 +101,22 @@ func (c *agentInfo) Run() error {
 			NixOS: c.All || c.NixOS,
 		}
 
-		var resp info.Response
-		if err = info.Get(encoded, nkey, req, &resp, 10*time.Second); err != nil {
-			return err
-		}
+		for idx, target := range targets {
+			var resp info.Response
+			if err = info.Get(encoded, target.NKey, req, &resp, 10*time.Second); err != nil {
+				return err
+			}
+
+			if idx > 0 {
+				println()
+			}
 
-		printAgentSummary(&resp)
-		printNix(resp.Nix)
-		printNixos(resp.NixOS)
-		printAgentHost(resp.Host)
-		printAgentLoad(resp.Load)
+			printAgentSummary(&resp)
+			printNix(resp.Nix)
+			printNixos(resp.NixOS)
+			printAgentHost(resp.Host)
+			printAgentLoad(resp.Load)
+		}
 
 		return
 	})
@@ -96,6 +128,16 @@ func printAgentSummary(agent *info.Response) {
 	kvPrintln("Name:", agent.Name)
 	kvPrintln("NKey:", agent.NKey)
 	kvPrintln("Subject:", agent.Subject)
+	kvPrintln("Labels:", formatLabels(agent.Labels))
+	if agent.Staged != "" {
+		kvPrintln("Staged:", agent.Staged)
+	}
+	if agent.Build != nil {
+		kvPrintln("Version:", agent.Build.String())
+	}
+	if agent.PreviousBuild != nil {
+		kvPrintln("Previous version:", agent.PreviousBuild.String())
+	}
 }
 
 func printAgentHost(host *host.InfoStat) {
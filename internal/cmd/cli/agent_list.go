@@ -2,6 +2,8 @@ package cli
 
 import (
 	"context"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/charmbracelet/bubbles/table"
@@ -14,7 +16,8 @@ import (
 )
 
 type agentList struct {
-	Nats nutil.CliOptions `embed:"" prefix:"nats-"`
+	Nats     nutil.CliOptions `embed:"" prefix:"nats-"`
+	Selector string           `help:"Only list agents whose labels match the selector e.g. site=oslo,role=gateway"`
 }
 
 func (l *agentList) Run() error {
@@ -32,8 +35,14 @@ func (l *agentList) Run() error {
 		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
 		defer cancel()
 
-		var agents []*info.Response
-		if agents, err = agent.List(ctx, conn); err != nil {
+		var (
+			agents   []*info.Response
+			selector agent.Selector
+		)
+
+		if selector, err = agent.ParseSelector(l.Selector); err != nil {
+			return
+		} else if agents, err = agent.List(ctx, conn); err != nil {
 			return err
 		}
 
@@ -41,11 +50,12 @@ func (l *agentList) Run() error {
 			{Title: "Name", Width: 32},
 			{Title: "NKey", Width: 57},
 			{Title: "Last Seen", Width: 24},
+			{Title: "Labels", Width: 48},
 		}
 
 		var rows []table.Row
-		for _, v := range agents {
-			row := table.Row{v.Name, v.NKey, timeago.English.Format(v.LastSeen)}
+		for _, v := range agent.Select(agents, selector) {
+			row := table.Row{v.Name, v.NKey, timeago.English.Format(v.LastSeen), formatLabels(v.Labels)}
 			rows = append(rows, row)
 		}
 
@@ -63,3 +73,12 @@ func (l *agentList) Run() error {
 		return
 	})
 }
+
+func formatLabels(labels map[string]string) string {
+	var pairs []string
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -24,8 +24,9 @@ type agentLogs struct {
 	Since     *time.Duration `help:"Time ago from which to start replaying logs." default:"5m" xor:"start"`
 	StartTime *time.Time     `help:"Time from which to start replaying logs." xor:"start"`
 
-	Output bool   `help:"output agent's stdout and stderr"`
-	Name   string `arg:"" optional:""`
+	Output   bool   `help:"output agent's stdout and stderr"`
+	Selector string `help:"Only show logs for agents whose labels match the selector e.g. site=oslo,role=gateway"`
+	Name     string `arg:"" optional:""`
 }
 
 func (c *agentLogs) Run() error {
@@ -33,6 +34,11 @@ func (c *agentLogs) Run() error {
 		return err
 	}
 
+	// kong only enforces xor between flags, not between a flag and a positional argument
+	if c.Name != "" && c.Selector != "" {
+		return errors.New("either a name or --selector can be specified, not both")
+	}
+
 	return cmd.Run(func(ctx context.Context) (err error) {
 		var (
 			conn *nats.Conn
@@ -63,8 +69,14 @@ func (c *agentLogs) Run() error {
 
 		// get a list of agents and index the responses
 
-		var agents []*info.Response
-		if agents, err = agent.List(listCtx, conn); err != nil {
+		var (
+			agents   []*info.Response
+			selector agent.Selector
+		)
+
+		if selector, err = agent.ParseSelector(c.Selector); err != nil {
+			return
+		} else if agents, err = agent.List(listCtx, conn); err != nil {
 			return
 		}
 
@@ -82,6 +94,17 @@ func (c *agentLogs) Run() error {
 		ctx = nlog.SetAgentsByName(ctx, byName)
 		ctx = nlog.SetAgentsByNKey(ctx, byNKey)
 
+		// when using a selector we listen to all agents and filter the records by nkey
+
+		var selected map[string]*info.Response
+		if c.Selector != "" {
+			if selected, err = agent.IndexByNKey(agent.Select(agents, selector)); err != nil {
+				return
+			} else if len(selected) == 0 {
+				return errors.Errorf("no agents match the selector '%s'", c.Selector)
+			}
+		}
+
 		// decide whether we are listening for a specific agents logs or all agents
 
 		if c.Name != "" {
@@ -124,6 +147,12 @@ func (c *agentLogs) Run() error {
 					continue
 				}
 
+				if selected != nil {
+					if _, ok := selected[subject.AgentNKeyForSubject(record.Msg().Subject)]; !ok {
+						continue
+					}
+				}
+
 				_, _ = record.Write(os.Stderr)
 			}
 		}
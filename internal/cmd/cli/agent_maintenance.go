@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"context"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/nats-io/nats.go"
+	"github.com/numtide/nits/internal/cmd"
+	"github.com/numtide/nits/pkg/agent"
+	"github.com/numtide/nits/pkg/maintenance"
+	nnats "github.com/numtide/nits/pkg/nats"
+)
+
+type agentMaintenanceSet struct {
+	Nats nnats.CliOptions `embed:"" prefix:"nats-"`
+
+	Name    string   `arg:"" help:"the name given to the agent"`
+	Windows []string `arg:"" help:"windows in the form '<days> <start>-<end> [<time zone>]' e.g. 'Sun 02:00-04:00 Europe/Oslo'"`
+}
+
+func (c *agentMaintenanceSet) Run() error {
+	if err := Cmd.Log.ConfigureLog(); err != nil {
+		return err
+	}
+
+	windows, err := maintenance.ParseAll(c.Windows)
+	if err != nil {
+		return err
+	}
+
+	return cmd.Run(func(ctx context.Context) (err error) {
+		var (
+			conn     *nats.Conn
+			js       nats.JetStreamContext
+			nkey     string
+			revision uint64
+		)
+
+		if conn, err = c.Nats.Connect(); err != nil {
+			return
+		} else if js, err = conn.JetStream(); err != nil {
+			return
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		if nkey, err = agent.ResolveNKey(ctx, conn, c.Name); err != nil {
+			return
+		} else if revision, err = maintenance.Set(js, nkey, windows); err != nil {
+			return
+		}
+
+		log.Info("maintenance windows set", "name", c.Name, "windows", windows, "revision", revision)
+		return
+	})
+}
+
+type agentMaintenanceClear struct {
+	Nats nnats.CliOptions `embed:"" prefix:"nats-"`
+
+	Name string `arg:"" help:"the name given to the agent"`
+}
+
+func (c *agentMaintenanceClear) Run() error {
+	if err := Cmd.Log.ConfigureLog(); err != nil {
+		return err
+	}
+
+	return cmd.Run(func(ctx context.Context) (err error) {
+		var (
+			conn *nats.Conn
+			js   nats.JetStreamContext
+			nkey string
+		)
+
+		if conn, err = c.Nats.Connect(); err != nil {
+			return
+		} else if js, err = conn.JetStream(); err != nil {
+			return
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		if nkey, err = agent.ResolveNKey(ctx, conn, c.Name); err != nil {
+			return
+		} else if err = maintenance.Clear(js, nkey); err != nil {
+			return
+		}
+
+		log.Info("maintenance windows cleared", "name", c.Name)
+		return
+	})
+}
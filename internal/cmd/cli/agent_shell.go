@@ -0,0 +1,169 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/numtide/nits/internal/cmd"
+	"github.com/numtide/nits/pkg/agent"
+	"github.com/numtide/nits/pkg/agent/exec"
+	nnats "github.com/numtide/nits/pkg/nats"
+	"github.com/numtide/nits/pkg/subject"
+	"golang.org/x/term"
+)
+
+// how often to let the agent know we are still here whilst the session is idle, see exec.ShellIdleTimeout
+const shellKeepAliveInterval = exec.ShellIdleTimeout / 4
+
+type agentShell struct {
+	Nats nnats.CliOptions `embed:"" prefix:"nats-"`
+
+	Name string `arg:"" help:"the name given to the agent"`
+}
+
+func (c *agentShell) Run() error {
+	if err := Cmd.Log.ConfigureLog(); err != nil {
+		return err
+	}
+
+	return cmd.Run(func(ctx context.Context) (err error) {
+		var (
+			opts    []nats.Option
+			conn    *nats.Conn
+			encoded *nats.EncodedConn
+			nkey    string
+		)
+
+		if opts, _, _, err = c.Nats.ToNatsOptions(); err != nil {
+			return
+		} else if conn, err = nats.Connect(c.Nats.Url, opts...); err != nil {
+			return
+		} else if encoded, err = nats.NewEncodedConn(conn, nats.JSON_ENCODER); err != nil {
+			return
+		}
+
+		resolveCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		if nkey, err = agent.ResolveNKey(resolveCtx, conn, c.Name); err != nil {
+			return
+		}
+
+		req := exec.ShellRequest{
+			Id:   nuid.Next(),
+			Term: os.Getenv("TERM"),
+		}
+
+		stdin := int(os.Stdin.Fd())
+		interactive := term.IsTerminal(stdin)
+
+		if interactive {
+			var width, height int
+			if width, height, err = term.GetSize(stdin); err != nil {
+				return errors.Annotate(err, "failed to determine terminal size")
+			}
+			req.Cols, req.Rows = uint16(width), uint16(height)
+		}
+
+		sessionSubject := subject.AgentShell(nkey, req.Id)
+
+		// subscribe to the output before the shell is started so that we cannot miss any of it
+		var (
+			closed    = make(chan struct{})
+			closeOnce sync.Once
+			outSub    *nats.Subscription
+		)
+
+		if outSub, err = conn.Subscribe(sessionSubject+".OUT", func(msg *nats.Msg) {
+			if isEOS, _ := nnats.IsEndOfStream(msg); isEOS {
+				closeOnce.Do(func() { close(closed) })
+				return
+			}
+			_, _ = os.Stdout.Write(msg.Data)
+		}); err != nil {
+			return
+		}
+		defer func() {
+			_ = outSub.Unsubscribe()
+		}()
+
+		var resp exec.ShellResponse
+		if resp, err = exec.ShellWithContext(ctx, encoded, nkey, req); err != nil {
+			return
+		}
+
+		log.Debug("shell opened", "name", c.Name, "session", req.Id, "logs", resp.Logs)
+
+		if interactive {
+			var state *term.State
+			if state, err = term.MakeRaw(stdin); err != nil {
+				return errors.Annotate(err, "failed to put terminal into raw mode")
+			}
+			defer func() {
+				_ = term.Restore(stdin, state)
+			}()
+
+			go relayWindowSize(ctx, conn, sessionSubject+".RESIZE", stdin)
+		}
+
+		in := &nnats.Writer{Conn: conn, Subject: sessionSubject + ".IN"}
+
+		go func() {
+			// the agent hangs up the shell once our input has ended
+			_, _ = io.Copy(in, os.Stdin)
+			_ = in.Close()
+		}()
+
+		keepAlive := time.NewTicker(shellKeepAliveInterval)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-closed:
+				return
+			case <-ctx.Done():
+				_ = in.Close()
+				return
+			case <-keepAlive.C:
+				_ = conn.Publish(in.Subject, nil)
+			}
+		}
+	})
+}
+
+// relayWindowSize publishes the size of the terminal whenever it changes.
+func relayWindowSize(ctx context.Context, conn *nats.Conn, subj string, fd int) {
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+	defer signal.Stop(resized)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-resized:
+		}
+
+		width, height, err := term.GetSize(fd)
+		if err != nil {
+			continue
+		}
+
+		data, err := json.Marshal(exec.WindowSize{Rows: uint16(height), Cols: uint16(width)})
+		if err != nil {
+			continue
+		}
+
+		_ = conn.Publish(subj, data)
+	}
+}
@@ -0,0 +1,89 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ettle/strcase"
+	"github.com/nats-io/nats.go"
+	"github.com/numtide/nits/internal/cmd"
+	"github.com/numtide/nits/pkg/agent"
+	"github.com/numtide/nits/pkg/agent/nixos"
+	nnats "github.com/numtide/nits/pkg/nats"
+	"github.com/xeonx/timeago"
+)
+
+type agentStatus struct {
+	Nats nnats.CliOptions `embed:"" prefix:"nats-"`
+	Name string           `arg:""`
+}
+
+func (c *agentStatus) Run() error {
+	if err := Cmd.Log.ConfigureLog(); err != nil {
+		return err
+	}
+
+	return cmd.Run(func(ctx context.Context) (err error) {
+		var (
+			conn    *nats.Conn
+			encoded *nats.EncodedConn
+			nkey    string
+		)
+
+		if conn, err = c.Nats.Connect(); err != nil {
+			return
+		} else if encoded, err = nats.NewEncodedConn(conn, nats.JSON_ENCODER); err != nil {
+			return
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		if nkey, err = agent.ResolveNKey(ctx, conn, c.Name); err != nil {
+			return
+		}
+
+		var status nixos.StatusResponse
+		if status, err = nixos.StatusWithContext(ctx, encoded, nkey); err != nil {
+			return
+		}
+
+		println(sectionHeaderStyle.Render(fmt.Sprintf("Status for agent %s:", c.Name)))
+		println()
+
+		if status.Staged != "" {
+			kvPrintln("Staged:", status.Staged)
+		}
+
+		if w := status.NextWindow; w == nil {
+			kvPrintln("Maintenance:", "unrestricted")
+		} else {
+			kvPrintln("Maintenance:", status.MaintenanceWindows.String())
+			if now := time.Now(); w.Start.After(now) {
+				kvPrintln("Next window:", fmt.Sprintf(
+					"%s - %s (%s)", w.Start.Format(time.RFC1123Z), w.End.Format(time.RFC1123Z), timeago.English.Format(w.Start),
+				))
+			} else {
+				kvPrintln("Next window:", fmt.Sprintf("open until %s", w.End.Format(time.RFC1123Z)))
+			}
+		}
+
+		d := status.Deployment
+		if d == nil {
+			kvPrintln("Deployment:", "none in progress")
+			return
+		}
+
+		kvPrintln("Deployment:", d.Id)
+		kvPrintln("Phase:", strcase.ToCase(d.Phase.String(), strcase.LowerCase, ' '))
+		kvPrintln("Started:", fmt.Sprintf("%s (%s)", d.Started.Format(time.RFC1123Z), timeago.English.Format(d.Started)))
+		kvPrintln("Action:", strcase.ToKebab(d.Request.Action.String()))
+		kvPrintln("Closure:", d.Request.Closure)
+		kvPrintln("Issuer:", d.Request.Issuer)
+		kvPrintln("Logs:", d.Logs)
+
+		return
+	})
+}
@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"context"
+
+	"github.com/charmbracelet/log"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/numtide/nits/internal/cmd"
+	"github.com/numtide/nits/pkg/cache"
+	nnats "github.com/numtide/nits/pkg/nats"
+)
+
+type cacheServe struct {
+	Nats nnats.CliOptions `embed:"" prefix:"nats-"`
+}
+
+func (c *cacheServe) Run() error {
+	if err := Cmd.Log.ConfigureLog(); err != nil {
+		return err
+	}
+
+	return cmd.Run(func(ctx context.Context) (err error) {
+		var (
+			conn *nats.Conn
+			srv  micro.Service
+		)
+
+		if conn, err = c.Nats.Connect(); err != nil {
+			return
+		} else if srv, err = cache.Serve(conn); err != nil {
+			return
+		}
+
+		defer func() {
+			_ = srv.Stop()
+		}()
+
+		log.Info("serving the local nix store", "service", srv.Info().Name)
+
+		<-ctx.Done()
+		return nil
+	})
+}
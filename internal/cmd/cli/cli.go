@@ -10,9 +10,32 @@ var Cmd struct {
 		List   agentList   `cmd:"" name:"ls" help:"List agents within a cluster"`
 		Info   agentInfo   `cmd:"" help:"Show info about an agent"`
 		Logs   agentLogs   `cmd:"" help:"Show logs for an agent"`
-		Deploy agentDeploy `cmd:"" help:"Deploy to an agent"`
+		Status agentStatus `cmd:"" help:"Show the deployment status of an agent"`
+		Deploy struct {
+			Start  agentDeploy       `cmd:"" default:"withargs" help:"Deploy to an agent"`
+			Cancel agentDeployCancel `cmd:"" help:"Cancel a deployment which is in progress"`
+		} `cmd:"" help:"Deploy to an agent"`
+		Deployments agentDeployments `cmd:"" help:"Show the deployment history of agents"`
+		Maintenance struct {
+			Set   agentMaintenanceSet   `cmd:"" help:"Set the maintenance windows in which an agent may activate a new system"`
+			Clear agentMaintenanceClear `cmd:"" help:"Clear an agent's maintenance windows, allowing it to activate at any time"`
+		} `cmd:"" help:"Manage agent maintenance windows"`
+		Generations struct {
+			List     agentGenerationsList     `cmd:"" default:"withargs" help:"List the system generations of an agent"`
+			Rollback agentGenerationsRollback `cmd:"" help:"Switch an agent to a previous system generation"`
+			Delete   agentGenerationsDelete   `cmd:"" help:"Delete old system generations of an agent"`
+		} `cmd:"" help:"Manage agent system generations"`
+		Gc    agentGc    `cmd:"" help:"Collect garbage in an agent's nix store"`
+		Exec  agentExec  `cmd:"" help:"Run a command on an agent"`
+		Shell agentShell `cmd:"" help:"Open an interactive shell on an agent"`
 	} `cmd:"" help:"Agent related functions"`
 
+	Deploy flakeDeploy `cmd:"" help:"Deploy a flake's nixosConfigurations to the agents with matching names"`
+
+	Cache struct {
+		Serve cacheServe `cmd:"" help:"Serve the local nix store to agents over NATS"`
+	} `cmd:"" help:"Cache related functions"`
+
 	Cluster struct {
 		Add clusterAdd `cmd:""`
 	} `cmd:"" help:"Cluster related functions"`
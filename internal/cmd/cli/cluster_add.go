@@ -10,7 +10,10 @@ import (
 	"github.com/numtide/nits/internal/cmd"
 
 	"github.com/charmbracelet/log"
+	"github.com/numtide/nits/pkg/agent/nixos"
+	"github.com/numtide/nits/pkg/cache"
 	nexec "github.com/numtide/nits/pkg/exec"
+	"github.com/numtide/nits/pkg/maintenance"
 )
 
 type clusterAdd struct {
@@ -88,13 +91,16 @@ func (c *clusterAdd) Run() (err error) {
 		return
 	}
 
-	var logsConfig, registryConfig *os.File
+	var logsConfig, registryConfig, deploymentsConfig *os.File
 	if logsConfig, err = openResourceLocally(streamConfig, "streams/agent-logs.json"); err != nil {
 		return err
 	}
 	if registryConfig, err = openResourceLocally(streamConfig, "streams/agent-registry.json"); err != nil {
 		return err
 	}
+	if deploymentsConfig, err = openResourceLocally(streamConfig, "streams/agent-deployments.json"); err != nil {
+		return err
+	}
 
 	log.Info("adding streams")
 
@@ -112,6 +118,38 @@ func (c *clusterAdd) Run() (err error) {
 		return
 	}
 
+	nats = cmd.LogExec(nexec.Nats("--context", adminContext, "stream", "add", "--config", deploymentsConfig.Name()))
+
+	if _, err = nats.Output(); err != nil {
+		nexec.LogError("failed to add deployments stream", err)
+		return
+	}
+
+	log.Info("adding key value stores")
+
+	nats = cmd.LogExec(nexec.Nats("--context", adminContext, "kv", "add", nixos.DesiredStateBucket, "--history", "10"))
+
+	if _, err = nats.Output(); err != nil {
+		nexec.LogError("failed to add desired state bucket", err)
+		return
+	}
+
+	nats = cmd.LogExec(nexec.Nats("--context", adminContext, "kv", "add", maintenance.Bucket))
+
+	if _, err = nats.Output(); err != nil {
+		nexec.LogError("failed to add maintenance windows bucket", err)
+		return
+	}
+
+	log.Info("adding object stores")
+
+	nats = cmd.LogExec(nexec.Nats("--context", adminContext, "object", "add", cache.Bucket))
+
+	if _, err = nats.Output(); err != nil {
+		nexec.LogError("failed to add cache object store", err)
+		return
+	}
+
 	log.Info("setup complete")
 
 	return nil
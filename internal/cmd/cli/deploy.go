@@ -0,0 +1,243 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+	"github.com/numtide/nits/internal/cmd"
+	"github.com/numtide/nits/pkg/agent"
+	"github.com/numtide/nits/pkg/agent/info"
+	"github.com/numtide/nits/pkg/agent/nixos"
+	nlog "github.com/numtide/nits/pkg/logging"
+	nnats "github.com/numtide/nits/pkg/nats"
+)
+
+type flakeDeploy struct {
+	Nats nnats.CliOptions `embed:"" prefix:"nats-"`
+
+	Flake     string `arg:"" default:"." help:"flake containing the nixosConfigurations to deploy"`
+	Attribute string `help:"attribute of each configuration to match against agent names e.g. config.networking.hostName, defaults to the configuration's name"`
+
+	Action   string `enum:"switch,boot,test,dry-activate,stage" default:"switch" help:"action to perform on the agents"`
+	Output   bool   `help:"output agents' stdout and stderr"`
+	Plan     bool   `help:"show the changes the deployment would make to each agent and ask for confirmation before deploying"`
+	Force    bool   `help:"activate immediately instead of waiting for the agents' maintenance windows"`
+	Transfer bool   `help:"upload the closures to the agents over NATS rather than have them fetched from a binary cache"`
+
+	Rollout rolloutOptions `embed:""`
+}
+
+func (f *flakeDeploy) Run() error {
+	if err := Cmd.Log.ConfigureLog(); err != nil {
+		return err
+	} else if err = f.Rollout.validate(); err != nil {
+		return err
+	}
+
+	return cmd.Run(func(ctx context.Context) (err error) {
+		var (
+			action  nixos.DeployAction
+			configs map[string]string
+		)
+
+		if action, err = nixos.DeployActionString(f.Action); err != nil {
+			return
+		} else if configs, err = f.configurations(); err != nil {
+			return
+		}
+
+		var (
+			opts    []nats.Option
+			js      nats.JetStreamContext
+			conn    *nats.Conn
+			encoded *nats.EncodedConn
+		)
+
+		if opts, _, _, err = f.Nats.ToNatsOptions(); err != nil {
+			return
+		} else if conn, err = nats.Connect(f.Nats.Url, opts...); err != nil {
+			return
+		} else if encoded, err = nats.NewEncodedConn(conn, nats.JSON_ENCODER); err != nil {
+			return
+		} else if js, err = conn.JetStream(); err != nil {
+			return
+		}
+
+		listCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		var (
+			agents         []*info.Response
+			byName, byNKey map[string]*info.Response
+		)
+
+		if agents, err = agent.List(listCtx, conn); err != nil {
+			return
+		} else if byName, err = agent.IndexByName(agents); err != nil {
+			return
+		} else if byNKey, err = agent.IndexByNKey(agents); err != nil {
+			return
+		}
+
+		// match configurations with agents
+
+		var (
+			targets      []*info.Response
+			installables []string
+			unmatched    []string
+			matched      = make(map[string]string)
+		)
+
+		for _, config := range sortedKeys(configs) {
+			name := configs[config]
+			if other, ok := matched[name]; ok {
+				return errors.Errorf("configurations %s and %s are both for the agent %s", other, config, name)
+			} else if target, ok := byName[name]; ok {
+				matched[name] = config
+				targets = append(targets, target)
+				installables = append(installables, f.installable(config))
+			} else {
+				unmatched = append(unmatched, config)
+			}
+		}
+
+		var unconfigured []string
+		for _, a := range agents {
+			if !containsValue(configs, a.Name) {
+				unconfigured = append(unconfigured, a.Name)
+			}
+		}
+		sort.Strings(unconfigured)
+
+		printFlakeReport(configs, unmatched, unconfigured)
+
+		if len(targets) == 0 {
+			return errors.New("no configurations match a registered agent")
+		}
+
+		var paths []string
+		if paths, err = buildClosures(installables...); err != nil {
+			return
+		}
+
+		var bucket string
+		if f.Transfer {
+			if bucket, err = transfer(ctx, js, paths...); err != nil {
+				return
+			}
+		}
+
+		requests := make(map[string]nixos.DeployRequest, len(targets))
+		for idx, target := range targets {
+			requests[target.NKey] = nixos.DeployRequest{
+				Action:  action,
+				Closure: paths[idx],
+				Cache:   bucket,
+				Force:   f.Force,
+			}
+		}
+
+		if f.Plan {
+			var proceed bool
+			if proceed, err = plan(ctx, encoded, targets, requests); err != nil {
+				return
+			} else if !proceed {
+				log.Info("deployment aborted")
+				return
+			}
+		}
+
+		// set agent indices in the context for the log writer
+		ctx = nlog.SetAgentsByName(ctx, byName)
+		ctx = nlog.SetAgentsByNKey(ctx, byNKey)
+
+		return f.Rollout.rollout(ctx, encoded, js, targets, requests, f.Output)
+	})
+}
+
+// configurations evaluates the flake's nixosConfigurations, returning the agent name for each configuration.
+func (f *flakeDeploy) configurations() (configs map[string]string, err error) {
+	apply := "builtins.mapAttrs (name: _: name)"
+	if f.Attribute != "" {
+		apply = fmt.Sprintf("builtins.mapAttrs (_: c: c.%s)", f.Attribute)
+	}
+
+	log.Info("evaluating nixosConfigurations", "flake", f.Flake, "attribute", f.Attribute)
+
+	eval := exec.Command("nix", "eval", "--json", f.Flake+"#nixosConfigurations", "--apply", apply)
+	out, err := eval.Output()
+	if err != nil {
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			_, _ = os.Stderr.Write(exit.Stderr)
+		}
+		return nil, fmt.Errorf("%w: failed to evaluate nixosConfigurations", err)
+	}
+
+	if err = json.Unmarshal(out, &configs); err != nil {
+		return nil, errors.Annotate(err, "failed to unmarshal nixosConfigurations")
+	}
+
+	return
+}
+
+func (f *flakeDeploy) installable(config string) string {
+	return fmt.Sprintf("%s#nixosConfigurations.%s.config.system.build.toplevel", f.Flake, nixString(config))
+}
+
+// nixStringEscaper escapes the characters which are special within a double-quoted nix string.
+var nixStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`)
+
+// nixString quotes s as a nix string, so that configuration names containing dots or other special characters can be
+// used as attribute names.
+func nixString(s string) string {
+	return `"` + nixStringEscaper.Replace(s) + `"`
+}
+
+func printFlakeReport(configs map[string]string, unmatched []string, unconfigured []string) {
+	println(sectionHeaderStyle.Render("Configurations without agents:"))
+	println()
+	if len(unmatched) == 0 {
+		println("none")
+	}
+	for _, config := range unmatched {
+		kvPrintln(config+":", configs[config])
+	}
+
+	println()
+	println(sectionHeaderStyle.Render("Agents without configurations:"))
+	println()
+	if len(unconfigured) == 0 {
+		println("none")
+	}
+	for _, name := range unconfigured {
+		println(name)
+	}
+	println()
+}
+
+func sortedKeys(m map[string]string) (keys []string) {
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+func containsValue(m map[string]string, value string) bool {
+	for _, v := range m {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
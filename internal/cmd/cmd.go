@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"context"
+	"fmt"
 	"os/exec"
 	"syscall"
 	"time"
@@ -36,6 +37,16 @@ func (lo *LogOptions) ConfigureLog() error {
 	return nil
 }
 
+// ExitError is returned by a command which should exit with the given status rather than reporting an error, such as
+// when relaying the exit status of a command run elsewhere.
+type ExitError struct {
+	Code int
+}
+
+func (e ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
 func Run(main func(ctx context.Context) error) (err error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
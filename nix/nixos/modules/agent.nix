@@ -31,6 +31,129 @@ in {
         description = mdDoc "Path to an ed25519 host key file";
       };
     };
+    trustedPublicKeys = mkOption {
+      type = types.listOf types.str;
+      default = [];
+      example = ["cache.example.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY="];
+      description = mdDoc ''
+        Public keys in the same format as `nix.settings.trusted-public-keys`. If set, every path in a closure must be
+        signed by one of them before the agent will activate it.
+      '';
+    };
+    deployTimeout = mkOption {
+      type = types.nullOr types.str;
+      default = null;
+      example = "30m";
+      description = mdDoc "Maximum duration of a deployment, after which it is cancelled. Activation is never interrupted and does not count towards it.";
+    };
+    confirmTimeout = mkOption {
+      type = types.str;
+      default = "2m";
+      example = "60s";
+      description = mdDoc ''
+        How long to wait after activation for the agent to confirm it can still reach NATS before rolling back.
+        Set to `0s` to disable it.
+      '';
+    };
+    healthChecks = {
+      failedUnits = mkOption {
+        type = types.bool;
+        default = false;
+        description = mdDoc "Roll back a deployment if any systemd units have failed after activation.";
+      };
+      units = mkOption {
+        type = types.listOf types.str;
+        default = [];
+        example = ["sshd.service"];
+        description = mdDoc "Systemd units which must be active after activation, otherwise the deployment is rolled back.";
+      };
+      command = mkOption {
+        type = types.nullOr types.str;
+        default = null;
+        example = "curl -sf http://localhost:8080/health";
+        description = mdDoc "A shell command which must exit successfully after activation, otherwise the deployment is rolled back.";
+      };
+      timeout = mkOption {
+        type = types.str;
+        default = "30s";
+        description = mdDoc "How long to wait for the health checks to pass.";
+      };
+    };
+    gc = {
+      threshold = mkOption {
+        type = types.ints.between 0 100;
+        default = 0;
+        example = 90;
+        description = mdDoc ''
+          Collect garbage automatically once the file system holding the nix store is more than this percentage full.
+          Set to `0` to disable.
+        '';
+      };
+      target = mkOption {
+        type = types.ints.between 0 100;
+        default = 0;
+        example = 75;
+        description = mdDoc ''
+          When collecting garbage automatically, stop once the file system is no more than this percentage full.
+          Set to `0` to collect all garbage.
+        '';
+      };
+      keepGenerations = mkOption {
+        type = types.ints.unsigned;
+        default = 0;
+        example = 5;
+        description = mdDoc ''
+          When collecting garbage automatically, delete all but this many of the most recent system generations first.
+          Set to `0` to keep them all.
+        '';
+      };
+      interval = mkOption {
+        type = types.str;
+        default = "10m";
+        description = mdDoc "How often to check the disk usage of the nix store.";
+      };
+    };
+    exec = {
+      allow = mkOption {
+        type = types.listOf types.str;
+        default = [];
+        example = ["systemctl status" "journalctl -u" "nix-store --verify"];
+        description = mdDoc ''
+          Commands which may be run remotely with `nits agent exec`. Each entry allows any command line which begins
+          with it.
+        '';
+      };
+      allowAll = mkOption {
+        type = types.bool;
+        default = false;
+        description = mdDoc "Allow any command to be run remotely with `nits agent exec`.";
+      };
+      timeout = mkOption {
+        type = types.str;
+        default = "10m";
+        description = mdDoc "Maximum duration of a remotely run command. Set to `0s` for no limit.";
+      };
+      shell = {
+        enable = mkEnableOption (mdDoc "interactive shells to be opened remotely with `nits agent shell`");
+        command = mkOption {
+          type = types.str;
+          default = "${pkgs.bashInteractive}/bin/bash";
+          defaultText = literalExpression ''"''${pkgs.bashInteractive}/bin/bash"'';
+          description = mdDoc "The shell to run as a login shell for remote sessions.";
+        };
+      };
+    };
+    substituter = {
+      enable = mkEnableOption (mdDoc ''
+        a binary cache on loopback which fetches paths over NATS from `nits cache serve`, and add it to the
+        substituters used by the nix daemon. Paths must still be signed by a key in `nix.settings.trusted-public-keys`
+      '');
+      port = mkOption {
+        type = types.port;
+        default = 5555;
+        description = mdDoc "Port on which the substituter listens.";
+      };
+    };
     logLevel = mkOption {
       type = types.enum ["debug" "info" "warn" "error"];
       default = "info";
@@ -40,6 +163,10 @@ in {
   };
 
   config = {
+    nix.settings.substituters = lib.mkIf cfg.substituter.enable [
+      "http://127.0.0.1:${toString cfg.substituter.port}"
+    ];
+
     systemd.services.nits-agent = {
       after = ["network.target"];
       wantedBy = ["sysinit.target"];
@@ -47,7 +174,7 @@ in {
       description = "Nits Agent";
       startLimitIntervalSec = 0;
 
-      # the agent will restart itself after a successful deployment
+      # the agent will restart itself after a successful deployment which changes its executable
       restartIfChanged = false;
 
       path = [
@@ -60,6 +187,35 @@ in {
         NATS_HOST_KEY_FILE = cfg.nats.hostKeyFile;
         NATS_JWT_FILE = cfg.nats.jwtFile;
         LOG_LEVEL = cfg.logLevel;
+        DEPLOY_TIMEOUT = cfg.deployTimeout;
+        TRUSTED_PUBLIC_KEYS =
+          if cfg.trustedPublicKeys == []
+          then null
+          else lib.concatStringsSep "," cfg.trustedPublicKeys;
+        CONFIRM_TIMEOUT = cfg.confirmTimeout;
+        HEALTH_CHECK_FAILED_UNITS = lib.boolToString cfg.healthChecks.failedUnits;
+        HEALTH_CHECK_UNITS =
+          if cfg.healthChecks.units == []
+          then null
+          else lib.concatStringsSep "," cfg.healthChecks.units;
+        HEALTH_CHECK_COMMAND = cfg.healthChecks.command;
+        HEALTH_CHECK_TIMEOUT = cfg.healthChecks.timeout;
+        GC_THRESHOLD = toString cfg.gc.threshold;
+        GC_TARGET = toString cfg.gc.target;
+        GC_KEEP_GENERATIONS = toString cfg.gc.keepGenerations;
+        GC_INTERVAL = cfg.gc.interval;
+        EXEC_ALLOW =
+          if cfg.exec.allow == []
+          then null
+          else lib.concatStringsSep "," cfg.exec.allow;
+        EXEC_ALLOW_ALL = lib.boolToString cfg.exec.allowAll;
+        EXEC_TIMEOUT = cfg.exec.timeout;
+        EXEC_SHELL = lib.boolToString cfg.exec.shell.enable;
+        EXEC_SHELL_COMMAND = cfg.exec.shell.command;
+        SUBSTITUTER_ADDRESS =
+          if cfg.substituter.enable
+          then "127.0.0.1:${toString cfg.substituter.port}"
+          else null;
       };
 
       serviceConfig = with lib; {
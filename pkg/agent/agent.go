@@ -6,8 +6,10 @@ import (
 	"os"
 
 	"github.com/nats-io/jwt/v2"
+	"github.com/numtide/nits/pkg/agent/exec"
 	"github.com/numtide/nits/pkg/agent/info"
 	"github.com/numtide/nits/pkg/agent/nixos"
+	"github.com/numtide/nits/pkg/agent/substituter"
 
 	"github.com/numtide/nits/pkg/agent/util"
 
@@ -51,6 +53,7 @@ func Run(ctx context.Context) (err error) {
 	ctx = util.SetConn(ctx, Conn)
 	ctx = util.SetNKey(ctx, NKey)
 	ctx = util.SetClaims(ctx, Claims)
+	ctx = util.SetStateDirectory(ctx, nixos.Options.StateDirectory)
 
 	log.Info("initialising services")
 	if err = info.Init(ctx); err != nil {
@@ -59,6 +62,12 @@ func Run(ctx context.Context) (err error) {
 	} else if err = nixos.Init(ctx); err != nil {
 		log.Error("failed to initialise nixos service", "error", err)
 		return
+	} else if err = substituter.Init(ctx); err != nil {
+		log.Error("failed to initialise substituter", "error", err)
+		return
+	} else if err = exec.Init(ctx); err != nil {
+		log.Error("failed to initialise exec service", "error", err)
+		return
 	}
 	log.Info("services initialised")
 
@@ -72,7 +81,11 @@ func connectNats() (err error) {
 	if opts, NKey, Claims, err = NatsOptions.ToNatsOptions(); err != nil {
 		return
 	}
-	opts = append(opts, nats.CustomInboxPrefix(subject.AgentInbox(NKey)))
+	opts = append(opts,
+		nats.CustomInboxPrefix(subject.AgentInbox(NKey)),
+		// keep trying to reconnect, a deployment may need to be rolled back before the server is reachable again
+		nats.MaxReconnects(-1),
+	)
 
 	if Conn, err = nats.Connect(NatsOptions.Url, opts...); err != nil {
 		return
@@ -0,0 +1,219 @@
+package exec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/juju/errors"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/nats-io/nuid"
+	"github.com/numtide/nits/pkg/agent/util"
+	nlog "github.com/numtide/nits/pkg/logging"
+	nnats "github.com/numtide/nits/pkg/nats"
+	"github.com/numtide/nits/pkg/subject"
+)
+
+var (
+	Conn   *nats.Conn
+	NKey   string
+	Claims *jwt.UserClaims
+	logger *log.Logger
+)
+
+type Request struct {
+	// the command to run followed by its arguments
+	Command []string `json:"command"`
+	// who requested the command, set by the agent from the request's signature
+	Issuer string `json:"issuer,omitempty"`
+}
+
+type Response struct {
+	Id   string `json:"id"`
+	Logs string `json:"logs"`
+}
+
+type Result struct {
+	Id       string `json:"id"`
+	ExitCode int    `json:"exit-code"`
+	// set if the command could not be run or did not exit by itself
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+func Init(ctx context.Context) (err error) {
+	Conn = util.GetConn(ctx)
+	NKey = util.GetNKey(ctx)
+	Claims = util.GetClaims(ctx)
+
+	logger = log.Default().With("service", "exec")
+
+	var srv micro.Service
+	if srv, err = micro.AddService(Conn, micro.Config{
+		Name:        "AgentExec",
+		Version:     "0.0.1",
+		Description: "Run commands and shells on the agent's host.",
+	}); err != nil {
+		return
+	}
+
+	if err = srv.AddEndpoint(
+		"EXEC", micro.HandlerFunc(handler), micro.WithEndpointSubject(subject.AgentService(NKey, "EXEC")),
+	); err != nil {
+		return
+	} else if err = srv.AddEndpoint(
+		"SHELL", micro.HandlerFunc(onShell), micro.WithEndpointSubject(subject.AgentService(NKey, "SHELL")),
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+func handler(req micro.Request) {
+	var (
+		err     error
+		request Request
+	)
+
+	if err = json.Unmarshal(req.Data(), &request); err != nil {
+		_ = req.Error("400", fmt.Sprintf("Failed to unmarshal request: %s", err), nil)
+		return
+	} else if request.Issuer, err = nnats.RequestIssuer(req, Claims); err != nil {
+		_ = req.Error("401", fmt.Sprintf("Failed to verify issuer: %s", err), nil)
+		return
+	} else if len(request.Command) == 0 {
+		_ = req.Error("400", "A command is required.", nil)
+		return
+	} else if !allowed(request.Command) {
+		logger.Warn("refused to run command", "issuer", request.Issuer, "command", request.Command)
+		_ = req.Error("403", fmt.Sprintf("Command is not allowed: %s", strings.Join(request.Command, " ")), nil)
+		return
+	}
+
+	if err = req.RespondJSON(run(request)); err != nil {
+		logger.Error("failed to respond", "error", err)
+	}
+}
+
+// allowed returns true if the command begins with one of the allowed command lines, or any command is allowed.
+func allowed(command []string) bool {
+	if Options.ExecAllowAll {
+		return true
+	}
+
+	for _, entry := range Options.ExecAllow {
+		prefix := strings.Fields(entry)
+		if len(prefix) == 0 || len(prefix) > len(command) {
+			continue
+		}
+
+		match := true
+		for idx := range prefix {
+			if prefix[idx] != command[idx] {
+				match = false
+				break
+			}
+		}
+
+		if match {
+			return true
+		}
+	}
+
+	return false
+}
+
+func run(request Request) Response {
+	id := nuid.Next()
+	logSubject := fmt.Sprintf("%s.EXEC.%s", subject.AgentLogs(NKey), id)
+
+	go func() {
+		sys := &nnats.Writer{
+			Conn:    Conn,
+			Subject: logSubject + ".SYS",
+			Headers: nats.Header{
+				nlog.HeaderFormat: []string{nlog.HeaderLogFmt},
+			},
+		}
+		stdout := &nnats.Writer{
+			Conn:    Conn,
+			Subject: logSubject + ".STDOUT",
+			Headers: nats.Header{
+				nlog.HeaderFormat: []string{nlog.HeaderTerm},
+			},
+		}
+		stderr := &nnats.Writer{
+			Conn:    Conn,
+			Subject: logSubject + ".STDERR",
+			Headers: nats.Header{
+				nlog.HeaderFormat: []string{nlog.HeaderTerm},
+			},
+		}
+
+		defer func() {
+			for _, w := range []*nnats.Writer{stderr, stdout, sys} {
+				if err := w.Close(); err != nil {
+					logger.Error("failed to close writer", "subject", w.Subject, "error", err)
+				}
+			}
+		}()
+
+		// the sys subject keeps an audit trail of what was run and by whom
+		l := log.New(sys)
+		l.SetTimeFormat(time.RFC3339)
+		l.SetFormatter(log.LogfmtFormatter)
+		l.SetReportTimestamp(true)
+
+		ctx := context.Background()
+		if Options.ExecTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, Options.ExecTimeout)
+			defer cancel()
+		}
+
+		logger.Info("running command", "id", id, "issuer", request.Issuer, "command", request.Command)
+		l.Info("running command", "issuer", request.Issuer, "command", strings.Join(request.Command, " "))
+
+		started := time.Now()
+		result := Result{Id: id}
+
+		cmd := exec.CommandContext(ctx, request.Command[0], request.Command[1:]...)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+
+		var exitErr *exec.ExitError
+		if err := cmd.Run(); errors.As(err, &exitErr) && ctx.Err() == nil {
+			result.ExitCode = exitErr.ExitCode()
+		} else if err != nil {
+			result.ExitCode = -1
+			if ctx.Err() != nil {
+				err = errors.Annotate(ctx.Err(), "command did not exit in time")
+			}
+			result.Error = err.Error()
+		}
+
+		result.Duration = time.Since(started)
+		l.Info("command exited", "exit-code", result.ExitCode, "error", result.Error, "duration", result.Duration)
+
+		// publish the result before closing the log subjects so that it is available to anyone waiting on them
+		if data, err := json.Marshal(result); err != nil {
+			logger.Error("failed to marshal exec result", "error", err)
+		} else if err = Conn.Publish(subject.AgentExecResult(NKey, id), data); err != nil {
+			logger.Error("failed to publish exec result", "error", err)
+		}
+	}()
+
+	return Response{Id: id, Logs: logSubject}
+}
+
+func ExecWithContext(ctx context.Context, conn *nats.EncodedConn, nkey string, req Request) (resp Response, err error) {
+	err = nnats.RequestWithContext(ctx, conn, subject.AgentService(nkey, "EXEC"), req, &resp)
+	return
+}
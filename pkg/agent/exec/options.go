@@ -0,0 +1,15 @@
+package exec
+
+import "time"
+
+// Options configures the behaviour of the exec service, it is expected to be set before Init is called.
+var Options = &CliOptions{}
+
+type CliOptions struct {
+	ExecAllow    []string      `env:"EXEC_ALLOW" help:"Commands which may be run remotely, each allows any command line which begins with it e.g. 'systemctl status'."`
+	ExecAllowAll bool          `env:"EXEC_ALLOW_ALL" help:"Allow any command to be run remotely."`
+	ExecTimeout  time.Duration `env:"EXEC_TIMEOUT" default:"10m" help:"Maximum duration of a remotely run command, zero means no limit."`
+
+	ExecShell        bool   `env:"EXEC_SHELL" help:"Allow interactive shells to be opened remotely."`
+	ExecShellCommand string `env:"EXEC_SHELL_COMMAND" default:"/bin/sh" help:"The shell to run as a login shell for remote sessions."`
+}
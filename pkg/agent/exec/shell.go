@@ -0,0 +1,236 @@
+package exec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/creack/pty"
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	nlog "github.com/numtide/nits/pkg/logging"
+	nnats "github.com/numtide/nits/pkg/nats"
+	"github.com/numtide/nits/pkg/subject"
+)
+
+// a session is hung up once nothing has been heard from the client for this long, clients send keep alives meanwhile
+const ShellIdleTimeout = time.Minute
+
+// session ids become a subject token, so they must not contain separators or wildcards
+var sessionIdRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+type ShellRequest struct {
+	// chosen by the client, which subscribes to the session's output beforehand so that none of it is missed
+	Id   string `json:"id"`
+	Term string `json:"term,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+	Cols uint16 `json:"cols,omitempty"`
+	// set by the agent from the request's signature
+	Issuer string `json:"issuer,omitempty"`
+}
+
+type ShellResponse struct {
+	// the subject beneath which the session is recorded
+	Logs string `json:"logs"`
+}
+
+// WindowSize is published to the session's RESIZE subject whenever the client's terminal is resized.
+type WindowSize struct {
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+func onShell(req micro.Request) {
+	var (
+		err      error
+		request  ShellRequest
+		response ShellResponse
+	)
+
+	if err = json.Unmarshal(req.Data(), &request); err != nil {
+		_ = req.Error("400", fmt.Sprintf("Failed to unmarshal request: %s", err), nil)
+		return
+	} else if request.Issuer, err = nnats.RequestIssuer(req, Claims); err != nil {
+		_ = req.Error("401", fmt.Sprintf("Failed to verify issuer: %s", err), nil)
+		return
+	} else if !Options.ExecShell {
+		logger.Warn("refused to open shell", "issuer", request.Issuer)
+		_ = req.Error("403", "Remote shells are not enabled.", nil)
+		return
+	} else if !sessionIdRegex.MatchString(request.Id) {
+		_ = req.Error("400", fmt.Sprintf("Malformed session id: %s", request.Id), nil)
+		return
+	}
+
+	if response, err = shell(request); err != nil {
+		_ = req.Error("500", err.Error(), nil)
+		return
+	}
+
+	if err = req.RespondJSON(response); err != nil {
+		logger.Error("failed to respond", "error", err)
+	}
+}
+
+func shell(request ShellRequest) (response ShellResponse, err error) {
+	sessionSubject := subject.AgentShell(NKey, request.Id)
+	logSubject := fmt.Sprintf("%s.SHELL.%s", subject.AgentLogs(NKey), request.Id)
+
+	var cmd *exec.Cmd
+	if cmd, err = shellCommand(request.Term); err != nil {
+		return
+	}
+
+	var ptmx *os.File
+	if ptmx, err = pty.StartWithSize(cmd, &pty.Winsize{Rows: request.Rows, Cols: request.Cols}); err != nil {
+		return response, errors.Annotate(err, "failed to start shell")
+	}
+
+	// hanging up the shell ends the session, just as it would for a terminal
+	hangup := func() {
+		_ = cmd.Process.Signal(syscall.SIGHUP)
+	}
+	idle := time.AfterFunc(ShellIdleTimeout, hangup)
+
+	var inSub, resizeSub *nats.Subscription
+
+	if inSub, err = Conn.Subscribe(sessionSubject+".IN", func(msg *nats.Msg) {
+		idle.Reset(ShellIdleTimeout)
+		if isEOS, _ := nnats.IsEndOfStream(msg); isEOS {
+			hangup()
+		} else if len(msg.Data) > 0 {
+			_, _ = ptmx.Write(msg.Data)
+		}
+	}); err != nil {
+		hangup()
+		return
+	}
+
+	if resizeSub, err = Conn.Subscribe(sessionSubject+".RESIZE", func(msg *nats.Msg) {
+		idle.Reset(ShellIdleTimeout)
+		var size WindowSize
+		if err := json.Unmarshal(msg.Data, &size); err != nil {
+			logger.Warn("failed to unmarshal window size", "session", request.Id, "error", err)
+		} else if err = pty.Setsize(ptmx, &pty.Winsize{Rows: size.Rows, Cols: size.Cols}); err != nil {
+			logger.Warn("failed to resize pty", "session", request.Id, "error", err)
+		}
+	}); err != nil {
+		_ = inSub.Unsubscribe()
+		hangup()
+		return
+	}
+
+	go func() {
+		out := &nnats.Writer{
+			Conn:    Conn,
+			Subject: sessionSubject + ".OUT",
+		}
+		// only the output is recorded, keystrokes would include anything typed at a password prompt
+		recording := &nnats.Writer{
+			Conn:    Conn,
+			Subject: logSubject + ".OUT",
+			Headers: nats.Header{
+				nlog.HeaderFormat: []string{nlog.HeaderTerm},
+			},
+		}
+		sys := &nnats.Writer{
+			Conn:    Conn,
+			Subject: logSubject + ".SYS",
+			Headers: nats.Header{
+				nlog.HeaderFormat: []string{nlog.HeaderLogFmt},
+			},
+		}
+
+		defer func() {
+			for _, w := range []*nnats.Writer{out, recording, sys} {
+				if err := w.Close(); err != nil {
+					logger.Error("failed to close writer", "subject", w.Subject, "error", err)
+				}
+			}
+		}()
+
+		l := log.New(sys)
+		l.SetTimeFormat(time.RFC3339)
+		l.SetFormatter(log.LogfmtFormatter)
+		l.SetReportTimestamp(true)
+
+		logger.Info("shell opened", "session", request.Id, "issuer", request.Issuer)
+		l.Info("shell opened", "issuer", request.Issuer, "shell", cmd.Path)
+
+		relayed := make(chan struct{})
+		go func() {
+			// reading fails once the shell has exited and the pty has been closed
+			_, _ = io.Copy(io.MultiWriter(out, recording), ptmx)
+			close(relayed)
+		}()
+
+		started := time.Now()
+		waitErr := cmd.Wait()
+
+		idle.Stop()
+		_ = inSub.Unsubscribe()
+		_ = resizeSub.Unsubscribe()
+
+		// give any remaining output a moment to be relayed, background processes may still hold the pty open
+		select {
+		case <-relayed:
+		case <-time.After(time.Second):
+		}
+		_ = ptmx.Close()
+		<-relayed
+
+		exitCode := 0
+		var exitErr *exec.ExitError
+		if errors.As(waitErr, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+
+		logger.Info("shell closed", "session", request.Id, "issuer", request.Issuer)
+		l.Info("shell closed", "exit-code", exitCode, "duration", time.Since(started))
+	}()
+
+	response.Logs = logSubject
+	return
+}
+
+// shellCommand prepares the configured shell to run as a login shell for the agent's user, with a clean environment.
+func shellCommand(term string) (*exec.Cmd, error) {
+	u, err := user.Current()
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to determine user")
+	}
+
+	if term == "" {
+		term = "xterm"
+	}
+
+	cmd := exec.Command(Options.ExecShellCommand)
+	// a leading dash tells the shell that it is a login shell
+	cmd.Args[0] = "-" + filepath.Base(Options.ExecShellCommand)
+	cmd.Dir = u.HomeDir
+	cmd.Env = []string{
+		"TERM=" + term,
+		"HOME=" + u.HomeDir,
+		"USER=" + u.Username,
+		"LOGNAME=" + u.Username,
+		"SHELL=" + Options.ExecShellCommand,
+		"PATH=" + os.Getenv("PATH"),
+	}
+
+	return cmd, nil
+}
+
+func ShellWithContext(ctx context.Context, conn *nats.EncodedConn, nkey string, req ShellRequest) (resp ShellResponse, err error) {
+	err = nnats.RequestWithContext(ctx, conn, subject.AgentService(nkey, "SHELL"), req, &resp)
+	return
+}
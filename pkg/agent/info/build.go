@@ -0,0 +1,61 @@
+package info
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/errors"
+	"github.com/numtide/nits/internal/build"
+)
+
+// Build identifies the agent binary which is running.
+type Build struct {
+	Version string `json:"version"`
+	// the resolved path of the agent's executable, which changes with every rebuild even if the version does not
+	Executable string `json:"executable"`
+}
+
+func (b Build) String() string {
+	return b.Version + " (" + b.Executable + ")"
+}
+
+func runningBuild() (*Build, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to determine executable")
+	} else if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return nil, errors.Annotate(err, "failed to resolve executable")
+	}
+	return &Build{Version: build.Version, Executable: executable}, nil
+}
+
+// recordBuild stores the given build in the state directory, returning the build which was recorded by the previous
+// run of the agent if it differs.
+func recordBuild(stateDirectory string, current *Build) (previous *Build, err error) {
+	if stateDirectory == "" {
+		return nil, nil
+	}
+
+	file := filepath.Join(stateDirectory, "build.json")
+
+	var data []byte
+	if data, err = os.ReadFile(file); err == nil {
+		var recorded Build
+		if err = json.Unmarshal(data, &recorded); err != nil {
+			return nil, errors.Annotatef(err, "failed to unmarshal recorded build: %s", file)
+		} else if recorded != *current {
+			previous = &recorded
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Annotatef(err, "failed to read recorded build: %s", file)
+	}
+
+	if data, err = json.Marshal(current); err != nil {
+		return
+	} else if err = os.WriteFile(file, data, 0o600); err != nil {
+		return nil, errors.Annotatef(err, "failed to record build: %s", file)
+	}
+
+	return
+}
@@ -30,6 +30,9 @@ var (
 	NKey   string
 	Claims *jwt.UserClaims
 	logger *log.Logger
+
+	// the agent binary which is running and, if it differs, the one which was running before the agent last restarted
+	agentBuild, previousBuild *Build
 )
 
 func Init(ctx context.Context) (err error) {
@@ -39,6 +42,18 @@ func Init(ctx context.Context) (err error) {
 
 	logger = log.Default().With("service", "info")
 
+	if agentBuild, err = runningBuild(); err != nil {
+		return
+	}
+
+	// a failure to record the build should not stop the agent from running
+	if previousBuild, err = recordBuild(util.GetStateDirectory(ctx), agentBuild); err != nil {
+		logger.Warn("failed to record build", "error", err)
+		err = nil
+	} else if previousBuild != nil {
+		logger.Info("agent build has changed since it last ran", "previous", previousBuild, "current", agentBuild)
+	}
+
 	_, err = micro.AddService(conn, micro.Config{
 		Name:        "AgentInfo",
 		Version:     "0.0.1",
@@ -51,11 +66,13 @@ func Init(ctx context.Context) (err error) {
 
 	// send a basic info package every second to the registry subject
 
-	info := Response{NKey: NKey, Name: Claims.Name, Subject: subject.AgentWithNKey(NKey)}
-
-	var heartbeat []byte
-	if heartbeat, err = json.Marshal(info); err != nil {
-		return err
+	info := Response{
+		NKey:          NKey,
+		Name:          Claims.Name,
+		Subject:       subject.AgentWithNKey(NKey),
+		Labels:        LabelsFromTags(Claims.Tags),
+		Build:         agentBuild,
+		PreviousBuild: previousBuild,
 	}
 
 	go func() {
@@ -63,8 +80,9 @@ func Init(ctx context.Context) (err error) {
 		subj := subject.AgentRegistration(NKey)
 
 		var (
-			err error
-			msg *nats.Msg
+			err       error
+			msg       *nats.Msg
+			heartbeat []byte
 		)
 
 		for {
@@ -72,6 +90,15 @@ func Init(ctx context.Context) (err error) {
 			case <-ctx.Done():
 				return
 			case <-ticker:
+				if info.Staged, err = nix.GetStagedSystem(); err != nil {
+					log.Error("failed to determine staged system", "error", err)
+				}
+
+				if heartbeat, err = json.Marshal(info); err != nil {
+					log.Error("failed to marshal registry heartbeat", "error", err)
+					continue
+				}
+
 				msg = nats.NewMsg(subj)
 				msg.Data = heartbeat
 				// conflate updates
@@ -120,9 +147,16 @@ func handler(req micro.Request) {
 
 func info(req *Request) (resp *Response, err error) {
 	resp = &Response{
-		NKey:    NKey,
-		Name:    Claims.Name,
-		Subject: subject.AgentWithNKey(NKey),
+		NKey:          NKey,
+		Name:          Claims.Name,
+		Subject:       subject.AgentWithNKey(NKey),
+		Labels:        LabelsFromTags(Claims.Tags),
+		Build:         agentBuild,
+		PreviousBuild: previousBuild,
+	}
+
+	if resp.Staged, err = nix.GetStagedSystem(); err != nil {
+		return nil, errors.Annotate(err, "failed to retrieve staged system")
 	}
 
 	if req.All || req.Cpus {
@@ -0,0 +1,36 @@
+package info
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/nats-io/jwt/v2"
+)
+
+// LabelTagSeparator separates the key and value of a label when it is stored as a tag in an agent's user JWT.
+const LabelTagSeparator = ":"
+
+// LabelTags converts labels into tags for an agent's user JWT. Tags are lowercased when they are added to a JWT, so
+// labels are lowercased here too, making them case-insensitive throughout.
+func LabelTags(labels map[string]string) (tags []string, err error) {
+	for key, value := range labels {
+		if key == "" || strings.Contains(key, LabelTagSeparator) {
+			return nil, errors.Errorf("malformed label key: '%s'", key)
+		}
+		tags = append(tags, strings.ToLower(key+LabelTagSeparator+value))
+	}
+	sort.Strings(tags)
+	return
+}
+
+// LabelsFromTags extracts labels from the tags of an agent's user JWT. Tags which are not labels are ignored.
+func LabelsFromTags(tags jwt.TagList) map[string]string {
+	labels := make(map[string]string)
+	for _, tag := range tags {
+		if key, value, ok := strings.Cut(tag, LabelTagSeparator); ok {
+			labels[strings.ToLower(key)] = strings.ToLower(value)
+		}
+	}
+	return labels
+}
@@ -0,0 +1,91 @@
+package info
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+func TestLabelTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		expected []string
+		err      bool
+	}{
+		{name: "none", labels: nil, expected: nil},
+		{
+			name:     "sorted",
+			labels:   map[string]string{"site": "oslo", "role": "gateway"},
+			expected: []string{"role:gateway", "site:oslo"},
+		},
+		{name: "lowercased", labels: map[string]string{"Site": "Oslo"}, expected: []string{"site:oslo"}},
+		{name: "value containing separator", labels: map[string]string{"url": "a:b"}, expected: []string{"url:a:b"}},
+		{name: "empty key", labels: map[string]string{"": "oslo"}, err: true},
+		{name: "key containing separator", labels: map[string]string{"a:b": "c"}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags, err := LabelTags(tt.labels)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", tags)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			} else if !reflect.DeepEqual(tags, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, tags)
+			}
+		})
+	}
+}
+
+func TestLabelsFromTags(t *testing.T) {
+	tags := jwt.TagList{"site:oslo", "url:a:b", "unrelated", "Role:Gateway"}
+	expected := map[string]string{"site": "oslo", "url": "a:b", "role": "gateway"}
+
+	if labels := LabelsFromTags(tags); !reflect.DeepEqual(labels, expected) {
+		t.Fatalf("expected %v, got %v", expected, labels)
+	}
+}
+
+func TestLabelsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		expected map[string]string
+	}{
+		{name: "empty", labels: map[string]string{}, expected: map[string]string{}},
+		{
+			name:     "lower case",
+			labels:   map[string]string{"site": "oslo", "role": "gateway"},
+			expected: map[string]string{"site": "oslo", "role": "gateway"},
+		},
+		{
+			name:     "mixed case",
+			labels:   map[string]string{"Site": "Oslo"},
+			expected: map[string]string{"site": "oslo"},
+		},
+		{name: "empty value", labels: map[string]string{"site": ""}, expected: map[string]string{"site": ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags, err := LabelTags(tt.labels)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// mimic adding the tags to a jwt, which lowercases them
+			var list jwt.TagList
+			list.Add(tags...)
+
+			if labels := LabelsFromTags(list); !reflect.DeepEqual(labels, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, labels)
+			}
+		})
+	}
+}
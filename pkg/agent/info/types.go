@@ -24,16 +24,24 @@ type Request struct {
 }
 
 type Response struct {
-	NKey    string         `json:"nkey"`
-	Name    string         `json:"name"`
-	Subject string         `json:"subject"`
-	Host    *host.InfoStat `json:"host,omitempty"`
-	Nix     *Nix           `json:"nix,omitempty"`
-	NixOS   *NixOS         `json:"nixos,omitempty"`
-	Cpus    []cpu.InfoStat `json:"cpus,omitempty"`
-	Load    *Load          `json:"load,omitempty"`
-	Memory  *Memory        `json:"memory,omitempty"`
-	Disk    *Disk          `json:"disk,omitempty"`
+	NKey    string            `json:"nkey"`
+	Name    string            `json:"name"`
+	Subject string            `json:"subject"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	// the system closure which has been staged for activation, if any
+	Staged string `json:"staged,omitempty"`
+	// the agent binary which is running
+	Build *Build `json:"build,omitempty"`
+	// the agent binary which was running before the agent last restarted, set if it was different e.g. after an upgrade
+	PreviousBuild *Build `json:"previous-build,omitempty"`
+
+	Host   *host.InfoStat `json:"host,omitempty"`
+	Nix    *Nix           `json:"nix,omitempty"`
+	NixOS  *NixOS         `json:"nixos,omitempty"`
+	Cpus   []cpu.InfoStat `json:"cpus,omitempty"`
+	Load   *Load          `json:"load,omitempty"`
+	Memory *Memory        `json:"memory,omitempty"`
+	Disk   *Disk          `json:"disk,omitempty"`
 
 	LastSeen time.Time
 }
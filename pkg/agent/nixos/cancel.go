@@ -0,0 +1,69 @@
+package nixos
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	nnats "github.com/numtide/nits/pkg/nats"
+	"github.com/numtide/nits/pkg/subject"
+)
+
+type CancelRequest struct {
+	// the id of the deployment to cancel, if empty whichever deployment is in progress will be cancelled
+	Id string `json:"id"`
+	// who requested the cancellation, set by the agent from the request's signature
+	Issuer string `json:"issuer,omitempty"`
+}
+
+type CancelResponse struct {
+	Id string `json:"id"`
+}
+
+func onCancel(req micro.Request) {
+	var (
+		err     error
+		request CancelRequest
+	)
+
+	if len(req.Data()) > 0 {
+		// we accept empty request data as cancelling whatever is in progress
+		if err = json.Unmarshal(req.Data(), &request); err != nil {
+			_ = req.Error("400", fmt.Sprintf("Failed to unmarshal request: %s", err), nil)
+			return
+		}
+	}
+
+	if request.Issuer, err = nnats.RequestIssuer(req, Claims); err != nil {
+		_ = req.Error("401", fmt.Sprintf("Failed to verify issuer: %s", err), nil)
+		return
+	}
+
+	d := currentDeployment.Load()
+	if d == nil || d.operation != "" {
+		_ = req.Error("404", "No deployment is in progress.", nil)
+		return
+	} else if !(request.Id == "" || request.Id == d.id) {
+		_ = req.Error("404", fmt.Sprintf("Deployment %s is not in progress.", request.Id), nil)
+		return
+	}
+
+	// the cause ends up in the deployment's logs and result, recording who cancelled it
+	if !d.tryCancel(fmt.Errorf("%w by %s", ErrDeploymentCancelled, request.Issuer)) {
+		_ = req.Error("409", "The deployment is activating and can no longer be cancelled.", nil)
+		return
+	}
+
+	logger.Info("cancelled deployment", "id", d.id, "issuer", request.Issuer)
+
+	if err = req.RespondJSON(CancelResponse{Id: d.id}); err != nil {
+		logger.Error("failed to respond", "error", err)
+	}
+}
+
+func CancelWithContext(ctx context.Context, conn *nats.EncodedConn, nkey string, req CancelRequest) (resp CancelResponse, err error) {
+	err = nnats.RequestWithContext(ctx, conn, subject.AgentService(nkey, "NIXOS.DEPLOY.CANCEL"), req, &resp)
+	return
+}
@@ -0,0 +1,38 @@
+package nixos
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/numtide/nits/pkg/subject"
+)
+
+const confirmInterval = 1 * time.Second
+
+// confirm publishes a confirmation for the deployment, retrying until the server has acknowledged it or the confirm
+// timeout has elapsed. Activating a bad network configuration may prevent us from ever reaching the server again, in
+// which case the deployment must be rolled back.
+func (d *deployment) confirm(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, Options.ConfirmTimeout)
+	defer cancel()
+
+	subj := subject.AgentDeploymentConfirm(NKey, d.id)
+
+	for {
+		// flushing waits for a round trip to the server, which tells us it has received the confirmation
+		if Conn.IsConnected() {
+			if err := Conn.Publish(subj, []byte(d.id)); err == nil {
+				if err = Conn.FlushWithContext(ctx); err == nil {
+					return nil
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Annotate(ctx.Err(), "failed to reach nats after activation")
+		case <-time.After(confirmInterval):
+		}
+	}
+}
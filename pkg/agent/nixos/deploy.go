@@ -4,18 +4,19 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"os"
+	"path/filepath"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/ettle/strcase"
+	"github.com/juju/errors"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/micro"
 	"github.com/nats-io/nuid"
 	"github.com/nix-community/go-nix/pkg/storepath"
-	nlog "github.com/numtide/nits/pkg/logging"
+	"github.com/numtide/nits/pkg/cache"
 	nnats "github.com/numtide/nits/pkg/nats"
 	"github.com/numtide/nits/pkg/nix"
 	"github.com/numtide/nits/pkg/subject"
@@ -23,35 +24,227 @@ import (
 
 type DeployAction int
 
+type DeployPhase int
+
 const (
 	Switch DeployAction = iota
 	Boot
 	Test
 	DryActivate
+	// Stage fetches the closure and keeps it in the store so that it can be activated later
+	Stage
+)
+
+const (
+	Fetching DeployPhase = iota
+	Building
+	Switching
+	SettingSystem
+	Confirming
+	CheckingHealth
+	RollingBack
+	Staging
+	AwaitingWindow
+	Verifying
+)
+
+const (
+	ErrDeploymentInProgress = errors.ConstError("a deployment is in progress")
+	ErrDeploymentCancelled  = errors.ConstError("deployment was cancelled")
+	ErrDeploymentTimedOut   = errors.ConstError("deployment timed out")
 )
 
-// the id of the deployment currently in progress
-var currentDeployId = atomic.Value{}
+// deployment tracks a deployment which is in progress
+type deployment struct {
+	// set if this is not a deployment but another operation holding the current deployment, see reserve
+	operation string
+
+	id      string
+	logs    string
+	request DeployRequest
+	started time.Time
+	phase   atomic.Int32
+	cancel  context.CancelCauseFunc
+
+	// cancels the deployment once it has run for longer than the deploy timeout, see startTimeout
+	timeout  *time.Timer
+	deadline time.Time
+
+	// guards activating, which is set whilst the deployment cannot be cancelled, see beginActivation
+	mu         sync.Mutex
+	activating bool
+
+	// the system which was in place before the deployment, see currentSystem
+	previousSystem string
+	// the generation of the system profile which was current before the system was set, used when rolling back
+	previousGeneration int
+}
+
+func (d *deployment) enter(phase DeployPhase, result *DeployResult) {
+	d.phase.Store(int32(phase))
+	result.Phase = phase
+	d.save()
+}
+
+func (d *deployment) startTimeout(timeout time.Duration) {
+	d.deadline = time.Now().Add(timeout)
+	d.timeout = time.AfterFunc(timeout, func() {
+		d.tryCancel(ErrDeploymentTimedOut)
+	})
+}
+
+// tryCancel cancels the deployment with the given cause, returning false if it is activating and cannot be cancelled.
+func (d *deployment) tryCancel(cause error) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.activating {
+		return false
+	}
+
+	d.cancel(cause)
+	return true
+}
+
+// beginActivation prevents the deployment from being cancelled and pauses the deploy timeout, returning the time which
+// remained. Killing switch-to-configuration or nix-env part way through would leave the host in an unknown state, so
+// once activation has started it runs to completion, and is rolled back afterwards if need be. It returns the cause if
+// the deployment was cancelled beforehand.
+func (d *deployment) beginActivation(ctx context.Context) (time.Duration, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := context.Cause(ctx); err != nil {
+		return 0, err
+	}
+
+	d.activating = true
+	return d.pauseTimeout(), nil
+}
+
+func (d *deployment) endActivation(remaining time.Duration) {
+	d.mu.Lock()
+	d.activating = false
+	d.mu.Unlock()
+
+	d.resumeTimeout(remaining)
+}
+
+// pauseTimeout stops the deploy timeout, returning the time which remained. It returns zero if there is no timeout.
+func (d *deployment) pauseTimeout() time.Duration {
+	if d.timeout == nil || !d.timeout.Stop() {
+		return 0
+	}
+	return time.Until(d.deadline)
+}
+
+func (d *deployment) resumeTimeout(remaining time.Duration) {
+	if remaining > 0 {
+		d.startTimeout(remaining)
+	}
+}
+
+// the deployment currently in progress, if any
+var currentDeployment = atomic.Pointer[deployment]{}
+
+// reserve takes the place of the current deployment for an operation which must not run alongside a deployment, such
+// as deleting generations, so that no deployment can start until it is released. It returns false if a deployment or
+// another operation is already in progress.
+func reserve(operation string) (*deployment, bool) {
+	d := &deployment{operation: operation}
+	return d, currentDeployment.CompareAndSwap(nil, d)
+}
+
+// release ends an operation started with reserve, then applies any desired state which arrived whilst it was running.
+func (d *deployment) release() {
+	if currentDeployment.CompareAndSwap(d, nil) {
+		reconcilePending()
+	}
+}
 
 type DeployRequest struct {
 	Action  DeployAction `json:"action"`
 	Closure string       `json:"closure"`
+	// who or what requested the deployment, the agent records the verified signer of a request in its place
+	Issuer string `json:"issuer,omitempty"`
+	// name of an object store from which to fetch any store paths missing from the agent's nix store
+	Cache string `json:"cache,omitempty"`
+	// activate immediately rather than waiting for a maintenance window
+	Force bool `json:"force,omitempty"`
+	// an existing generation of the system profile which holds the closure, set when rolling back to it
+	Generation int `json:"generation,omitempty"`
+
+	// a nix profile to set to the closure instead of the system profile, which allows deploying to hosts other than
+	// NixOS e.g. /nix/var/nix/profiles/per-user/app/default. Only Switch is supported.
+	Profile string `json:"profile,omitempty"`
+	// path of a script within the closure to run once the profile has been set e.g. activate for home-manager
+	Activate string `json:"activate,omitempty"`
+	// the user to run the activation script as, defaults to root
+	User string `json:"user,omitempty"`
+}
+
+// validate checks that the request is well-formed.
+func (r DeployRequest) validate() error {
+	if r.Profile == "" {
+		if r.Activate != "" || r.User != "" {
+			return errors.New("an activation script and user can only be given for a profile deployment")
+		}
+		return nil
+	}
+
+	if r.Action != Switch {
+		return errors.Errorf("%s is not supported for a profile deployment", r.Action)
+	} else if !filepath.IsAbs(r.Profile) {
+		return errors.Errorf("profile must be an absolute path: %s", r.Profile)
+	} else if filepath.Clean(r.Profile) == nix.SystemProfile {
+		return errors.New("the system profile cannot be used for a profile deployment")
+	} else if r.Generation > 0 {
+		return errors.New("a generation cannot be given for a profile deployment")
+	} else if r.Activate != "" && !filepath.IsLocal(r.Activate) {
+		return errors.Errorf("activation script must be a relative path within the closure: %s", r.Activate)
+	} else if r.User != "" && r.Activate == "" {
+		return errors.New("a user can only be given along with an activation script")
+	}
+
+	return nil
+}
+
+// DeployRecord is published to the deployments stream when a deployment starts.
+type DeployRecord struct {
+	Id      string        `json:"id"`
+	Request DeployRequest `json:"request"`
 }
 
 type DeployResponse struct {
-	Id   string `json:"id"`
-	Logs string `json:"logs"`
+	Id     string `json:"id"`
+	Logs   string `json:"logs"`
+	Result string `json:"result"`
 }
 
 type DeployResult struct {
-	Success bool `json:"success"`
+	Id      string `json:"id"`
+	Success bool   `json:"success"`
+	// the last phase which was entered, if the deployment failed this is the phase in which it failed
+	Phase          DeployPhase   `json:"phase"`
+	Error          string        `json:"error,omitempty"`
+	Duration       time.Duration `json:"duration"`
+	PreviousSystem string        `json:"previous-system"`
+	NewSystem      string        `json:"new-system"`
+	Confirmed      bool          `json:"confirmed"`
+	RolledBack     bool          `json:"rolled-back"`
+	RollbackError  string        `json:"rollback-error,omitempty"`
+	// what activating the closure would do, set by a successful DryActivate
+	DryActivation *nix.DryActivation `json:"dry-activation,omitempty"`
+	// what activating the closure did, set by Switch and Test
+	Activation *nix.ActivationReport `json:"activation,omitempty"`
 }
 
 func onDeploy(req micro.Request) {
 	var (
-		err     error
-		request DeployRequest
-		closure *storepath.StorePath
+		err      error
+		request  DeployRequest
+		closure  *storepath.StorePath
+		response DeployResponse
 	)
 
 	if err = json.Unmarshal(req.Data(), &request); err != nil {
@@ -59,108 +252,436 @@ func onDeploy(req micro.Request) {
 		return
 	}
 
+	if request.Issuer, err = nnats.RequestIssuer(req, Claims); err != nil {
+		_ = req.Error("401", fmt.Sprintf("Failed to verify issuer: %s", err), nil)
+		return
+	}
+
 	if closure, err = storepath.FromAbsolutePath(request.Closure); err != nil {
 		_ = req.Error("400", fmt.Sprintf("Malformed closure: %s", err), nil)
 		return
 	}
 
+	if response, err = deploy(request, closure); errors.Is(err, ErrDeploymentInProgress) {
+		_ = req.Error("417", "A deployment is in progress.", nil)
+		return
+	} else if err != nil {
+		_ = req.Error("400", err.Error(), nil)
+		return
+	}
+
+	if err = req.RespondJSON(response); err != nil {
+		logger.Error("failed to respond", "error", err)
+	}
+	return
+}
+
+func deploy(request DeployRequest, closure *storepath.StorePath) (response DeployResponse, err error) {
+	if err = request.validate(); err != nil {
+		return
+	}
+
 	id := nuid.Next()
 	logSubject := fmt.Sprintf("%s.NIXOS.DEPLOY.%s", subject.AgentLogs(NKey), id)
 
-	if !currentDeployId.CompareAndSwap("", id) {
-		_ = req.Error("417", "A deployment is in progress.", nil)
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	d := &deployment{
+		id:      id,
+		logs:    logSubject,
+		request: request,
+		started: time.Now(),
+		cancel:  cancel,
+	}
+
+	if !currentDeployment.CompareAndSwap(nil, d) {
+		cancel(nil)
+		err = ErrDeploymentInProgress
 		return
 	}
 
-	go func() {
-		currentDeployId.Store(id)
-		defer currentDeployId.Store("")
+	if Options.DeployTimeout > 0 {
+		d.startTimeout(Options.DeployTimeout)
+	}
+
+	go d.execute(ctx, func(ctx context.Context, l *log.Logger, result *DeployResult) (err error) {
+		if err = publishRecord(DeployRecord{Id: id, Request: request}); err != nil {
+			log.Error("failed to publish deployment record", "error", err)
+		}
+
+		l.Info("starting deployment", "issuer", request.Issuer)
 
-		logWriter := &nnats.Writer{
-			Conn:    Conn,
-			Subject: logSubject + ".SYS",
-			Headers: nats.Header{
-				nlog.HeaderFormat: []string{nlog.HeaderLogFmt},
-			},
+		if d.previousSystem, err = currentSystem(request); err != nil {
+			l.Warn("failed to determine current system", "error", err)
 		}
+		result.PreviousSystem = d.previousSystem
+
+		return d.run(ctx, l, closure, result)
+	})
+
+	response = DeployResponse{
+		Id:     id,
+		Logs:   logSubject,
+		Result: subject.AgentDeploymentResult(NKey, id),
+	}
+	return
+}
+
+// execute runs fn with the deployment's logs, publishes the result and clears the current deployment afterwards.
+func (d *deployment) execute(ctx context.Context, fn func(ctx context.Context, l *log.Logger, result *DeployResult) error) {
+	// set if the deployment changed the agent's own executable
+	var upgrade string
 
-		outWriter := &nnats.Writer{
-			Conn:    Conn,
-			Subject: logSubject + ".STDOUT",
-			Headers: nats.Header{
-				nlog.HeaderFormat: []string{nlog.HeaderTerm},
-			},
+	defer func() {
+		if d.timeout != nil {
+			d.timeout.Stop()
 		}
+		d.cancel(nil)
 
-		errWriter := &nnats.Writer{
-			Conn:    Conn,
-			Subject: logSubject + ".STDERR",
-			Headers: nats.Header{
-				nlog.HeaderFormat: []string{nlog.HeaderTerm},
-			},
+		if upgrade != "" {
+			// the logs have been closed by now, the deployment remains current so that no other can start meanwhile
+			restart(upgrade)
+			return
 		}
 
-		l := log.New(io.MultiWriter(os.Stdout, logWriter))
-		l.SetTimeFormat(time.RFC3339)
-		l.SetLevel(log.DebugLevel)
-		l.SetFormatter(log.LogfmtFormatter)
-		l.SetReportTimestamp(true)
+		currentDeployment.Store(nil)
+		// apply any desired state which arrived whilst we were busy
+		reconcilePending()
+	}()
 
-		ctx := context.Background()
-		ctx = nix.SetStdOut(ctx, outWriter)
-		ctx = nix.SetStdError(ctx, outWriter)
+	logs := openLogs(d.logs)
+	defer logs.close()
 
-		defer func() {
-			if err := errWriter.Close(); err != nil {
-				log.Error("failed to close nats outWriter", "error", err)
-			} else if err := outWriter.Close(); err != nil {
-				log.Error("failed to close nats outWriter", "error", err)
-			} else if err := logWriter.Close(); err != nil {
-				log.Error("failed to close nats logWriter", "error", err)
-			}
-		}()
+	l := logs.logger()
+	ctx = logs.context(ctx)
+
+	result := DeployResult{
+		Id:             d.id,
+		Phase:          DeployPhase(d.phase.Load()),
+		PreviousSystem: d.previousSystem,
+	}
+
+	err := fn(ctx, l, &result)
+	if err != nil && context.Cause(ctx) != nil {
+		// report why the context was cancelled rather than the resulting process error
+		err = context.Cause(ctx)
+	}
+
+	if err == nil {
+		result.Success = true
+		l.Info("deployment complete")
+		upgrade = d.upgradeTarget(l)
+	} else {
+		result.Error = err.Error()
+		l.Error("deployment failed", "phase", result.Phase, "error", err)
+	}
+
+	if result.NewSystem, err = currentSystem(d.request); err != nil {
+		l.Warn("failed to determine new system", "error", err)
+	}
+
+	result.Duration = time.Since(d.started)
+
+	// publish the result before closing the log subjects so that it is available to anyone waiting on them
+	if err = publishResult(result); err != nil {
+		log.Error("failed to publish deployment result", "error", err)
+	}
+
+	// the deployment is over, there is nothing to finalise should we restart
+	d.clearState()
+}
+
+func (d *deployment) run(ctx context.Context, l *log.Logger, closure *storepath.StorePath, result *DeployResult) (err error) {
+	request := d.request
 
-		action := strcase.ToKebab(request.Action.String())
+	if request.Cache != "" {
+		d.enter(Fetching, result)
+		l.Info("fetching closure", "cache", request.Cache)
+		if err = fetchClosure(ctx, l, request.Cache, closure); err != nil {
+			l.Error("failed to fetch closure", "error", err)
+			return
+		}
+	}
 
-		l.Info("starting deployment")
+	var staged string
+	if staged, err = stagedClosure(request); err != nil {
+		l.Warn("failed to determine staged closure", "error", err)
+	}
 
+	if staged == closure.Absolute() && request.Action != Stage {
+		l.Info("closure has been staged, skipping build", "closure", closure)
+	} else {
+		d.enter(Building, result)
 		l.Info("building closure", "closure", closure)
 		if err = nix.Build(closure, nil, ctx); err != nil {
 			l.Error("failed to build closure", "error", err)
 			return
 		}
+	}
+
+	if len(trustedKeys) > 0 {
+		d.enter(Verifying, result)
+		l.Info("verifying closure signatures", "keys", len(trustedKeys))
+		if err = verifyClosure(closure, request.Generation); err != nil {
+			l.Error("failed to verify closure", "error", err)
+			return
+		}
+	}
+
+	if request.Action == Stage {
+		d.enter(Staging, result)
+		l.Info("staging closure")
+		if err = nix.StageSystem(closure, ctx); err != nil {
+			l.Error("failed to stage closure", "error", err)
+		}
+		return
+	}
+
+	return d.activate(ctx, l, closure, result, staged)
+}
+
+// activate waits for a maintenance window to open if need be, then activates the closure and checks the result. staged
+// is the closure which had been staged beforehand, if any.
+func (d *deployment) activate(
+	ctx context.Context, l *log.Logger, closure *storepath.StorePath, result *DeployResult, staged string,
+) (err error) {
+	request := d.request
+
+	if request.Action != DryActivate && !request.Force && !maintenanceWindows().Open(time.Now()) {
+		// keep the closure in the store whilst we wait
+		d.enter(Staging, result)
+		l.Info("staging closure until the maintenance window opens")
+		if err = stageClosure(request, closure, ctx); err != nil {
+			l.Error("failed to stage closure", "error", err)
+			return
+		}
+		staged = closure.Absolute()
+
+		d.enter(AwaitingWindow, result)
+		if err = d.awaitWindow(ctx, l); err != nil {
+			l.Error("failed whilst waiting for maintenance window", "error", err)
+			return
+		}
+	}
+
+	if request.Profile != "" {
+		err = d.activateProfile(ctx, l, closure, result)
+	} else {
+		err = d.activateSystem(ctx, l, closure, result)
+	}
+
+	if err != nil {
+		return
+	}
+
+	// the profile now keeps the closure alive
+	if staged == closure.Absolute() && (request.Action == Switch || request.Action == Boot) {
+		if err = unstageClosure(request); err != nil {
+			l.Warn("failed to remove staged closure", "error", err)
+			err = nil
+		}
+	}
+
+	if !(request.Action == Switch || request.Action == Test) {
+		return
+	}
+
+	return d.check(ctx, l, result)
+}
+
+// check confirms connectivity and the health of the system after activation, rolling back if either fails.
+func (d *deployment) check(ctx context.Context, l *log.Logger, result *DeployResult) (err error) {
+	// revert the activation unless we can still reach nats afterwards
+	if Options.ConfirmTimeout > 0 {
+		d.enter(Confirming, result)
+		l.Info("confirming connectivity", "timeout", Options.ConfirmTimeout)
+		if err = d.confirm(ctx); err != nil {
+			l.Error("failed to confirm connectivity", "error", err)
+			d.revert(ctx, l, result)
+			return
+		}
+		l.Info("connectivity confirmed")
+		result.Confirmed = true
+	}
+
+	if Options.healthChecksEnabled() {
+		d.enter(CheckingHealth, result)
+		l.Info("checking health")
+		if err = d.checkHealth(ctx, l); err != nil {
+			l.Error("health check failed", "error", err)
+			d.revert(ctx, l, result)
+			return
+		}
+	}
+
+	return
+}
+
+// activateSystem switches to a NixOS system closure and sets the system profile as required by the action.
+func (d *deployment) activateSystem(ctx context.Context, l *log.Logger, closure *storepath.StorePath, result *DeployResult) (err error) {
+	request := d.request
+	action := strcase.ToKebab(request.Action.String())
+
+	var remaining time.Duration
+	if remaining, err = d.beginActivation(ctx); err != nil {
+		return
+	}
+	defer d.endActivation(remaining)
+
+	if request.Action == Boot || request.Action == Switch {
+		// determined before activating so that it is persisted should we need to roll back after a restart
+		if d.previousGeneration, err = nix.CurrentGeneration(nix.SystemProfile); err != nil {
+			l.Warn("failed to determine current generation", "error", err)
+			err = nil
+		}
+	}
+
+	d.enter(Switching, result)
+	l.Info("switching configuration", "action", action)
+
+	if request.Action == DryActivate {
+		var activation nix.DryActivation
+		if activation, err = nix.DryActivate(closure, ctx); err != nil {
+			l.Error("failed to switch configuration", "error", err)
+			return
+		}
+
+		result.DryActivation = &activation
+		l.Info("dry activation complete",
+			"stop", len(activation.Units.Stop),
+			"start", len(activation.Units.Start),
+			"restart", len(activation.Units.Restart),
+			"reload", len(activation.Units.Reload),
+			"reboot-required", activation.RebootRequired,
+		)
+		return
+	}
+
+	if request.Action == Switch || request.Action == Test {
+		report, activateErr := nix.Activate(closure, action, ctx)
+		result.Activation = &report
 
-		l.Info("switching configuration", "action", action)
-		if err = nix.Switch(closure, action, ctx); err != nil {
+		l.Info("activation report",
+			"stopped", len(report.Units.Stop),
+			"started", len(report.Units.Start),
+			"restarted", len(report.Units.Restart),
+			"reloaded", len(report.Units.Reload),
+			"failed", len(report.Failed),
+			"exit-status", report.ExitStatus,
+		)
+
+		if err = activateErr; err != nil {
 			l.Error("failed to switch configuration", "error", err)
 			return
 		}
+	} else if err = nix.Switch(closure, action, ctx); err != nil {
+		l.Error("failed to switch configuration", "error", err)
+		return
+	}
 
-		switch request.Action {
-		case Boot, Switch:
+	switch request.Action {
+	case Boot, Switch:
+		d.enter(SettingSystem, result)
+
+		if request.Generation > 0 {
+			l.Info("switching generation", "generation", request.Generation)
+			if err = nix.SwitchGeneration(nix.SystemProfile, request.Generation, ctx); err != nil {
+				l.Error("failed to switch generation", "error", err)
+				return
+			}
+		} else {
 			l.Info("setting system")
 			if err = nix.SetSystem(closure, ctx); err != nil {
 				l.Error("failed to set system", "error", err)
 				return
 			}
-		default:
-			// do nothing
 		}
+	default:
+		// do nothing
+	}
 
-		l.Info("deployment complete")
+	return
+}
 
-		return
-	}()
+// verifyClosure checks that every path within the closure is signed by a trusted key. A closure which is being
+// switched to as an existing generation of the system profile is trusted as long as the generation does hold it.
+func verifyClosure(closure *storepath.StorePath, generation int) error {
+	if generation > 0 {
+		generations, err := nix.ListGenerations()
+		if err != nil {
+			return errors.Annotate(err, "failed to list generations")
+		}
+		for _, gen := range generations {
+			if gen.Number == generation && gen.Path == closure.Absolute() {
+				return nil
+			}
+		}
+		return errors.Errorf("generation %d does not hold %s", generation, closure)
+	}
 
-	response := DeployResponse{
-		Id:   id,
-		Logs: logSubject,
+	infos, err := nix.QueryPathInfo(true, closure.Absolute())
+	if err != nil {
+		return errors.Annotate(err, "failed to query path info")
 	}
+	return cache.VerifySignatures(infos, trustedKeys)
+}
 
-	if err = req.RespondJSON(response); err != nil {
-		logger.Error("failed to respond", "error", err)
+// currentSystem returns the system which the given request operates on: the profile for a profile deployment, the
+// system profile for Boot, the staged system for Stage, and the running system for everything else.
+func currentSystem(request DeployRequest) (string, error) {
+	if request.Profile != "" {
+		return nix.GetProfile(request.Profile)
 	}
-	return
+
+	switch request.Action {
+	case Boot:
+		return nix.GetSystemProfile()
+	case Stage:
+		return nix.GetStagedSystem()
+	default:
+		return nix.GetSystem()
+	}
+}
+
+// stagedClosure returns the closure staged for the kind of deployment in the request. A profile deployment has a GC
+// root of its own, so that it neither reuses nor replaces a system staged with the Stage action.
+func stagedClosure(request DeployRequest) (string, error) {
+	if request.Profile != "" {
+		return nix.GetStagedProfile()
+	}
+	return nix.GetStagedSystem()
+}
+
+// stageClosure adds the GC root for the kind of deployment in the request, see stagedClosure.
+func stageClosure(request DeployRequest, closure *storepath.StorePath, ctx context.Context) error {
+	if request.Profile != "" {
+		return nix.StageProfile(closure, ctx)
+	}
+	return nix.StageSystem(closure, ctx)
+}
+
+// unstageClosure removes the GC root for the kind of deployment in the request, see stagedClosure.
+func unstageClosure(request DeployRequest) error {
+	if request.Profile != "" {
+		return nix.UnstageProfile()
+	}
+	return nix.UnstageSystem()
+}
+
+func publishRecord(record DeployRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return Conn.Publish(subject.AgentDeploymentRequest(NKey, record.Id), data)
+}
+
+func publishResult(result DeployResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return Conn.Publish(subject.AgentDeploymentResult(NKey, result.Id), data)
 }
 
 func DeployWithContext(ctx context.Context, conn *nats.EncodedConn, nkey string, req DeployRequest) (resp DeployResponse, err error) {
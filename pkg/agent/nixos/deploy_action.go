@@ -8,11 +8,11 @@ import (
 	"strings"
 )
 
-const _DeployActionName = "SwitchBootTestDryActivate"
+const _DeployActionName = "SwitchBootTestDryActivateStage"
 
-var _DeployActionIndex = [...]uint8{0, 6, 10, 14, 25}
+var _DeployActionIndex = [...]uint8{0, 6, 10, 14, 25, 30}
 
-const _DeployActionLowerName = "switchboottestdryactivate"
+const _DeployActionLowerName = "switchboottestdryactivatestage"
 
 func (i DeployAction) String() string {
 	if i < 0 || i >= DeployAction(len(_DeployActionIndex)-1) {
@@ -29,9 +29,10 @@ func _DeployActionNoOp() {
 	_ = x[Boot-(1)]
 	_ = x[Test-(2)]
 	_ = x[DryActivate-(3)]
+	_ = x[Stage-(4)]
 }
 
-var _DeployActionValues = []DeployAction{Switch, Boot, Test, DryActivate}
+var _DeployActionValues = []DeployAction{Switch, Boot, Test, DryActivate, Stage}
 
 var _DeployActionNameToValueMap = map[string]DeployAction{
 	_DeployActionName[0:6]:        Switch,
@@ -42,6 +43,8 @@ var _DeployActionNameToValueMap = map[string]DeployAction{
 	_DeployActionLowerName[10:14]: Test,
 	_DeployActionName[14:25]:      DryActivate,
 	_DeployActionLowerName[14:25]: DryActivate,
+	_DeployActionName[25:30]:      Stage,
+	_DeployActionLowerName[25:30]: Stage,
 }
 
 var _DeployActionNames = []string{
@@ -49,6 +52,7 @@ var _DeployActionNames = []string{
 	_DeployActionName[6:10],
 	_DeployActionName[10:14],
 	_DeployActionName[14:25],
+	_DeployActionName[25:30],
 }
 
 // DeployActionString retrieves an enum value from the enum constants string name.
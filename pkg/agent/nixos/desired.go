@@ -0,0 +1,112 @@
+package nixos
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+	"github.com/nix-community/go-nix/pkg/storepath"
+)
+
+// DesiredStateBucket is the name of the KV bucket which holds the desired DeployRequest for each agent, keyed by NKey.
+const DesiredStateBucket = "agent-desired-state"
+
+// desired state which could not be applied because a deployment was already in progress
+var pendingDesiredState = atomic.Pointer[DeployRequest]{}
+
+// Schedule records req as the desired state for the agent with the given nkey. The agent will converge on it when
+// it is next connected.
+func Schedule(js nats.JetStreamContext, nkey string, req DeployRequest) (revision uint64, err error) {
+	var (
+		kv   nats.KeyValue
+		data []byte
+	)
+
+	if req.Action == DryActivate {
+		return 0, errors.Errorf("%s cannot be scheduled", req.Action)
+	} else if kv, err = js.KeyValue(DesiredStateBucket); err != nil {
+		return
+	} else if data, err = json.Marshal(req); err != nil {
+		return
+	}
+
+	return kv.Put(nkey, data)
+}
+
+func watchDesiredState(ctx context.Context) (err error) {
+	var (
+		js      nats.JetStreamContext
+		kv      nats.KeyValue
+		watcher nats.KeyWatcher
+	)
+
+	if js, err = Conn.JetStream(); err != nil {
+		return
+	} else if kv, err = js.KeyValue(DesiredStateBucket); err != nil {
+		return
+	} else if watcher, err = kv.Watch(NKey, nats.Context(ctx)); err != nil {
+		return
+	}
+
+	go func() {
+		for entry := range watcher.Updates() {
+			// a nil entry indicates we have caught up with the current value
+			if entry == nil || entry.Operation() != nats.KeyValuePut {
+				continue
+			}
+
+			var request DeployRequest
+			if err := json.Unmarshal(entry.Value(), &request); err != nil {
+				logger.Error("failed to unmarshal desired state", "revision", entry.Revision(), "error", err)
+				continue
+			}
+
+			logger.Info("desired state received", "revision", entry.Revision(), "closure", request.Closure)
+			reconcile(request)
+		}
+	}()
+
+	return
+}
+
+func reconcile(request DeployRequest) {
+	closure, err := storepath.FromAbsolutePath(request.Closure)
+	if err != nil {
+		logger.Error("malformed closure in desired state", "closure", request.Closure, "error", err)
+		return
+	}
+
+	if request.Action == DryActivate {
+		logger.Warn("ignoring desired state", "action", request.Action)
+		return
+	}
+
+	var current string
+	if current, err = currentSystem(request); err != nil {
+		logger.Error("failed to determine current system", "error", err)
+		return
+	} else if current == closure.Absolute() {
+		logger.Info("system matches desired state", "closure", request.Closure)
+		return
+	}
+
+	var resp DeployResponse
+	if resp, err = deploy(request, closure); errors.Is(err, ErrDeploymentInProgress) {
+		logger.Info("deployment in progress, desired state will be applied afterwards")
+		pendingDesiredState.Store(&request)
+		return
+	} else if err != nil {
+		logger.Error("invalid desired state", "error", err)
+		return
+	}
+
+	logger.Info("converging on desired state", "id", resp.Id, "action", request.Action, "closure", request.Closure)
+}
+
+func reconcilePending() {
+	if request := pendingDesiredState.Swap(nil); request != nil {
+		reconcile(*request)
+	}
+}
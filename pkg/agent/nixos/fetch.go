@@ -0,0 +1,49 @@
+package nixos
+
+import (
+	"context"
+	"os"
+
+	"github.com/charmbracelet/log"
+	"github.com/nats-io/nats.go"
+	"github.com/nix-community/go-nix/pkg/storepath"
+	"github.com/numtide/nits/pkg/cache"
+	"github.com/numtide/nits/pkg/nix"
+)
+
+// fetchClosure imports any paths within the closure which are missing from the local store from the given object
+// store, so that the deployment does not depend on reaching a binary cache. If trusted keys are configured, the paths
+// must be signed by one of them, otherwise nix requires them to be signed by one of its own trusted public keys.
+func fetchClosure(ctx context.Context, l *log.Logger, bucket string, closure *storepath.StorePath) (err error) {
+	var (
+		js      nats.JetStreamContext
+		obs     nats.ObjectStore
+		dir     string
+		fetched []string
+	)
+
+	if js, err = Conn.JetStream(); err != nil {
+		return
+	} else if obs, err = js.ObjectStore(bucket); err != nil {
+		return
+	} else if dir, err = os.MkdirTemp("", "nits-cache-"); err != nil {
+		return
+	}
+
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			l.Warn("failed to remove cache directory", "dir", dir, "error", err)
+		}
+	}()
+
+	if fetched, err = cache.Fetch(ctx, obs, closure, dir, trustedKeys); err != nil {
+		return
+	} else if len(fetched) == 0 {
+		l.Info("closure is already present in the nix store")
+		return
+	}
+
+	l.Info("importing paths", "count", len(fetched))
+	// the signatures have been verified against our trusted keys, which nix may not know about
+	return nix.Copy("file://"+dir, closure, len(trustedKeys) == 0, ctx)
+}
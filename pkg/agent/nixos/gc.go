@@ -0,0 +1,242 @@
+package nixos
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/dustin/go-humanize"
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/nats-io/nuid"
+	"github.com/nix-community/go-nix/pkg/storepath"
+	nnats "github.com/numtide/nits/pkg/nats"
+	"github.com/numtide/nits/pkg/nix"
+	"github.com/numtide/nits/pkg/subject"
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+const ErrGcInProgress = errors.ConstError("garbage collection is in progress")
+
+// the operation under which garbage collection reserves the current deployment
+const gcOperation = "garbage collection"
+
+type GcRequest struct {
+	// stop once this many bytes have been freed, zero means no limit
+	MaxFreed uint64 `json:"max-freed,omitempty"`
+	// stop once the file system holding the nix store has this many bytes free, zero means no limit
+	MinFree uint64 `json:"min-free,omitempty"`
+	// delete all but this many of the most recent system generations beforehand, zero keeps them all
+	KeepGenerations int `json:"keep-generations,omitempty"`
+	// who or what requested the garbage collection, set by the agent from the request's signature
+	Issuer string `json:"issuer,omitempty"`
+}
+
+type GcResponse struct {
+	Id   string `json:"id"`
+	Logs string `json:"logs"`
+}
+
+type GcResult struct {
+	Id      string `json:"id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	// the system generations which were deleted
+	DeletedGenerations []int `json:"deleted-generations,omitempty"`
+	// free space on the file system holding the nix store before and after collecting garbage
+	FreeBefore uint64        `json:"free-before"`
+	FreeAfter  uint64        `json:"free-after"`
+	Duration   time.Duration `json:"duration"`
+}
+
+func onGc(req micro.Request) {
+	var (
+		err      error
+		request  GcRequest
+		response GcResponse
+	)
+
+	if len(req.Data()) > 0 {
+		// we accept empty request data as collecting all garbage
+		if err = json.Unmarshal(req.Data(), &request); err != nil {
+			_ = req.Error("400", fmt.Sprintf("Failed to unmarshal request: %s", err), nil)
+			return
+		}
+	}
+
+	if request.Issuer, err = nnats.RequestIssuer(req, Claims); err != nil {
+		_ = req.Error("401", fmt.Sprintf("Failed to verify issuer: %s", err), nil)
+		return
+	}
+
+	if request.KeepGenerations < 0 {
+		_ = req.Error("400", "The number of generations to keep cannot be negative.", nil)
+		return
+	}
+
+	if response, err = gc(request); errors.Is(err, ErrGcInProgress) {
+		_ = req.Error("417", "Garbage collection is in progress.", nil)
+		return
+	} else if errors.Is(err, ErrDeploymentInProgress) {
+		_ = req.Error("417", "A deployment is in progress.", nil)
+		return
+	}
+
+	if err = req.RespondJSON(response); err != nil {
+		logger.Error("failed to respond", "error", err)
+	}
+}
+
+// gc starts collecting garbage in the background. No deployment may start until it has finished, as deleting
+// generations would race with a deployment setting the system profile, and collecting garbage could remove a closure
+// which has been fetched but not yet rooted.
+func gc(request GcRequest) (response GcResponse, err error) {
+	slot, ok := reserve(gcOperation)
+	if !ok {
+		if d := currentDeployment.Load(); d != nil && d.operation == gcOperation {
+			return response, ErrGcInProgress
+		}
+		return response, ErrDeploymentInProgress
+	}
+
+	id := nuid.Next()
+	logSubject := fmt.Sprintf("%s.NIX.GC.%s", subject.AgentLogs(NKey), id)
+
+	go func() {
+		defer slot.release()
+
+		logs := openLogs(logSubject)
+		defer logs.close()
+
+		l := logs.logger()
+		ctx := logs.context(context.Background())
+
+		l.Info("starting garbage collection", "issuer", request.Issuer)
+
+		started := time.Now()
+		result := GcResult{Id: id}
+
+		if err := collectGarbage(ctx, l, request, &result); err != nil {
+			result.Error = err.Error()
+			l.Error("garbage collection failed", "error", err)
+		} else {
+			result.Success = true
+			l.Info("garbage collection complete",
+				"freed", humanize.IBytes(result.FreeAfter-min(result.FreeBefore, result.FreeAfter)),
+				"free", humanize.IBytes(result.FreeAfter),
+			)
+		}
+
+		result.Duration = time.Since(started)
+
+		// publish the result before closing the log subjects so that it is available to anyone waiting on them
+		if data, err := json.Marshal(result); err != nil {
+			log.Error("failed to marshal garbage collection result", "error", err)
+		} else if err = Conn.Publish(subject.AgentGcResult(NKey, id), data); err != nil {
+			log.Error("failed to publish garbage collection result", "error", err)
+		}
+	}()
+
+	response = GcResponse{Id: id, Logs: logSubject}
+	return
+}
+
+func collectGarbage(ctx context.Context, l *log.Logger, request GcRequest, result *GcResult) (err error) {
+	if result.FreeBefore, err = storeFree(); err != nil {
+		return
+	}
+	result.FreeAfter = result.FreeBefore
+
+	if request.KeepGenerations > 0 {
+		spec := fmt.Sprintf("+%d", request.KeepGenerations)
+		if result.DeletedGenerations, err = deleteGenerations(ctx, l, spec); err != nil {
+			return
+		}
+	}
+
+	maxFreed := request.MaxFreed
+	if request.MinFree > 0 {
+		if result.FreeBefore >= request.MinFree {
+			l.Info("nix store already has enough free space", "free", humanize.IBytes(result.FreeBefore))
+			return
+		}
+
+		// never free more than was asked for
+		needed := request.MinFree - result.FreeBefore
+		if maxFreed == 0 || needed < maxFreed {
+			maxFreed = needed
+		}
+	}
+
+	l.Info("collecting garbage", "max-freed", humanize.IBytes(maxFreed))
+	if err = nix.CollectGarbage(maxFreed, ctx); err != nil {
+		return errors.Annotate(err, "failed to collect garbage")
+	}
+
+	result.FreeAfter, err = storeFree()
+	return
+}
+
+// storeFree returns the number of bytes available on the file system holding the nix store.
+func storeFree() (uint64, error) {
+	usage, err := disk.Usage(storepath.StoreDir)
+	if err != nil {
+		return 0, errors.Annotate(err, "failed to determine disk usage")
+	}
+	return usage.Free, nil
+}
+
+// autoGc periodically checks the disk usage of the nix store, collecting garbage once it exceeds the threshold.
+func autoGc(ctx context.Context) {
+	ticker := time.NewTicker(Options.GcInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		usage, err := disk.Usage(storepath.StoreDir)
+		if err != nil {
+			logger.Error("failed to determine disk usage", "error", err)
+			continue
+		} else if usage.UsedPercent < float64(Options.GcThreshold) {
+			continue
+		}
+
+		request := GcRequest{Issuer: "auto-gc"}
+
+		if Options.GcTarget > 0 {
+			request.MinFree = usage.Total * uint64(100-Options.GcTarget) / 100
+		}
+
+		if Options.GcKeepGenerations > 0 {
+			request.KeepGenerations = Options.GcKeepGenerations
+		}
+
+		logger.Info("disk usage has exceeded threshold, collecting garbage",
+			"used", fmt.Sprintf("%.1f%%", usage.UsedPercent),
+			"threshold", fmt.Sprintf("%d%%", Options.GcThreshold),
+		)
+
+		// we will try again next time if a deployment or garbage collection is in progress
+		var resp GcResponse
+		if resp, err = gc(request); errors.Is(err, ErrGcInProgress) {
+			logger.Debug("garbage collection is already in progress")
+		} else if errors.Is(err, ErrDeploymentInProgress) {
+			logger.Debug("deferring garbage collection whilst a deployment is in progress")
+		} else if err == nil {
+			logger.Info("garbage collection started", "id", resp.Id, "logs", resp.Logs)
+		}
+	}
+}
+
+func GcWithContext(ctx context.Context, conn *nats.EncodedConn, nkey string, req GcRequest) (resp GcResponse, err error) {
+	err = nnats.RequestWithContext(ctx, conn, subject.AgentService(nkey, "NIX.GC"), req, &resp)
+	return
+}
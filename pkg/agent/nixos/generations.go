@@ -0,0 +1,256 @@
+package nixos
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+
+	"github.com/charmbracelet/log"
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/nix-community/go-nix/pkg/storepath"
+	nnats "github.com/numtide/nits/pkg/nats"
+	"github.com/numtide/nits/pkg/nix"
+	"github.com/numtide/nits/pkg/subject"
+)
+
+var olderThanRegex = regexp.MustCompile(`^\d+d$`)
+
+type GenerationsResponse struct {
+	Generations []nix.Generation `json:"generations"`
+}
+
+type RollbackRequest struct {
+	// the generation of the system profile to switch to, defaults to the one before the current generation
+	Generation int `json:"generation,omitempty"`
+	// who or what requested the rollback, set by the agent from the request's signature
+	Issuer string `json:"issuer,omitempty"`
+	// activate immediately rather than waiting for a maintenance window
+	Force bool `json:"force,omitempty"`
+}
+
+type DeleteGenerationsRequest struct {
+	// delete all but the given number of most recent generations
+	Keep int `json:"keep,omitempty"`
+	// delete generations older than the given number of days, in the form <days>d e.g. 30d
+	OlderThan string `json:"older-than,omitempty"`
+	// who requested the deletion, set by the agent from the request's signature
+	Issuer string `json:"issuer,omitempty"`
+}
+
+type DeleteGenerationsResponse struct {
+	Deleted []int `json:"deleted"`
+}
+
+func onGenerations(req micro.Request) {
+	generations, err := nix.ListGenerations()
+	if err != nil {
+		_ = req.Error("500", fmt.Sprintf("Failed to list generations: %s", err), nil)
+		return
+	}
+
+	if err = req.RespondJSON(GenerationsResponse{Generations: generations}); err != nil {
+		logger.Error("failed to respond", "error", err)
+	}
+}
+
+func onRollback(req micro.Request) {
+	var (
+		err         error
+		request     RollbackRequest
+		generations []nix.Generation
+		closure     *storepath.StorePath
+		response    DeployResponse
+	)
+
+	if len(req.Data()) > 0 {
+		// we accept empty request data as rolling back to the previous generation
+		if err = json.Unmarshal(req.Data(), &request); err != nil {
+			_ = req.Error("400", fmt.Sprintf("Failed to unmarshal request: %s", err), nil)
+			return
+		}
+	}
+
+	if request.Issuer, err = nnats.RequestIssuer(req, Claims); err != nil {
+		_ = req.Error("401", fmt.Sprintf("Failed to verify issuer: %s", err), nil)
+		return
+	}
+
+	if generations, err = nix.ListGenerations(); err != nil {
+		_ = req.Error("500", fmt.Sprintf("Failed to list generations: %s", err), nil)
+		return
+	}
+
+	target, err := rollbackTarget(generations, request.Generation)
+	if err != nil {
+		_ = req.Error("400", err.Error(), nil)
+		return
+	} else if closure, err = storepath.FromAbsolutePath(target.Path); err != nil {
+		_ = req.Error("500", fmt.Sprintf("Malformed closure for generation %d: %s", target.Number, err), nil)
+		return
+	}
+
+	deployRequest := DeployRequest{
+		Action:     Switch,
+		Closure:    target.Path,
+		Generation: target.Number,
+		Issuer:     request.Issuer,
+		Force:      request.Force,
+	}
+
+	if response, err = deploy(deployRequest, closure); errors.Is(err, ErrDeploymentInProgress) {
+		_ = req.Error("417", "A deployment is in progress.", nil)
+		return
+	} else if err != nil {
+		_ = req.Error("500", fmt.Sprintf("Failed to start rollback: %s", err), nil)
+		return
+	}
+
+	if err = req.RespondJSON(response); err != nil {
+		logger.Error("failed to respond", "error", err)
+	}
+}
+
+// rollbackTarget finds the generation with the given number, or the one before the current generation if number is zero.
+func rollbackTarget(generations []nix.Generation, number int) (target nix.Generation, err error) {
+	current := slices.IndexFunc(generations, func(gen nix.Generation) bool {
+		return gen.Current
+	})
+
+	if number == 0 {
+		if current < 1 {
+			return target, errors.New("there is no generation before the current one")
+		}
+		return generations[current-1], nil
+	}
+
+	idx := slices.IndexFunc(generations, func(gen nix.Generation) bool {
+		return gen.Number == number
+	})
+
+	if idx == -1 {
+		return target, errors.Errorf("generation %d does not exist", number)
+	} else if idx == current {
+		return target, errors.Errorf("generation %d is already the current generation", number)
+	}
+
+	return generations[idx], nil
+}
+
+func onDeleteGenerations(req micro.Request) {
+	var (
+		err      error
+		request  DeleteGenerationsRequest
+		response DeleteGenerationsResponse
+	)
+
+	if err = json.Unmarshal(req.Data(), &request); err != nil {
+		_ = req.Error("400", fmt.Sprintf("Failed to unmarshal request: %s", err), nil)
+		return
+	} else if request.Issuer, err = nnats.RequestIssuer(req, Claims); err != nil {
+		_ = req.Error("401", fmt.Sprintf("Failed to verify issuer: %s", err), nil)
+		return
+	}
+
+	var spec string
+	if request.Keep > 0 && request.OlderThan == "" {
+		spec = fmt.Sprintf("+%d", request.Keep)
+	} else if request.Keep == 0 && olderThanRegex.MatchString(request.OlderThan) {
+		spec = request.OlderThan
+	} else {
+		_ = req.Error("400", "Either a number of generations to keep or an age in the form <days>d is required.", nil)
+		return
+	}
+
+	// deleting generations whilst a deployment is setting the system profile would race with it, so no deployment may
+	// start until we are done
+	slot, ok := reserve("deleting generations")
+	if !ok {
+		_ = req.Error("417", "A deployment is in progress.", nil)
+		return
+	}
+	defer slot.release()
+
+	// output from nix goes to the agent's own logs
+	ctx := nix.SetStdOut(context.Background(), os.Stdout)
+	ctx = nix.SetStdError(ctx, os.Stderr)
+
+	l := logger.With("issuer", request.Issuer)
+
+	if response.Deleted, err = deleteGenerations(ctx, l, spec); err != nil {
+		l.Error("failed to delete generations", "error", err)
+		_ = req.Error("500", err.Error(), nil)
+		return
+	}
+
+	l.Info("deleted generations", "generations", response.Deleted)
+
+	if err = req.RespondJSON(response); err != nil {
+		logger.Error("failed to respond", "error", err)
+	}
+}
+
+// deleteGenerations deletes generations of the system profile matching the spec and updates the boot loader
+// accordingly, returning the numbers of the generations which were deleted.
+func deleteGenerations(ctx context.Context, l *log.Logger, spec string) (deleted []int, err error) {
+	var (
+		before, after []nix.Generation
+		profile       string
+		closure       *storepath.StorePath
+	)
+
+	if before, err = nix.ListGenerations(); err != nil {
+		return nil, errors.Annotate(err, "failed to list generations")
+	}
+
+	l.Info("deleting generations", "spec", spec)
+	if err = nix.DeleteGenerations(spec, ctx); err != nil {
+		return nil, errors.Annotate(err, "failed to delete generations")
+	}
+
+	// re-install the boot loader so that its menu no longer offers the deleted generations
+	if profile, err = nix.GetSystemProfile(); err != nil {
+		return nil, errors.Annotate(err, "failed to determine system profile")
+	} else if closure, err = storepath.FromAbsolutePath(profile); err != nil {
+		return nil, errors.Annotate(err, "malformed system profile")
+	} else if err = nix.Switch(closure, "boot", ctx); err != nil {
+		return nil, errors.Annotate(err, "failed to update boot loader")
+	}
+
+	if after, err = nix.ListGenerations(); err != nil {
+		return nil, errors.Annotate(err, "failed to list generations")
+	}
+
+	for _, gen := range before {
+		if !slices.ContainsFunc(after, func(g nix.Generation) bool { return g.Number == gen.Number }) {
+			deleted = append(deleted, gen.Number)
+		}
+	}
+
+	l.Info("generations deleted", "generations", deleted)
+	return
+}
+
+func GenerationsWithContext(ctx context.Context, conn *nats.EncodedConn, nkey string) (resp GenerationsResponse, err error) {
+	err = nnats.RequestWithContext(ctx, conn, subject.AgentService(nkey, "NIXOS.GENERATIONS"), struct{}{}, &resp)
+	return
+}
+
+func RollbackWithContext(ctx context.Context, conn *nats.EncodedConn, nkey string, req RollbackRequest) (resp DeployResponse, err error) {
+	err = nnats.RequestWithContext(ctx, conn, subject.AgentService(nkey, "NIXOS.ROLLBACK"), req, &resp)
+	return
+}
+
+func DeleteGenerationsWithContext(
+	ctx context.Context,
+	conn *nats.EncodedConn,
+	nkey string,
+	req DeleteGenerationsRequest,
+) (resp DeleteGenerationsResponse, err error) {
+	err = nnats.RequestWithContext(ctx, conn, subject.AgentService(nkey, "NIXOS.GENERATIONS.DELETE"), req, &resp)
+	return
+}
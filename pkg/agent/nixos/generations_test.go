@@ -0,0 +1,49 @@
+package nixos
+
+import (
+	"testing"
+
+	"github.com/numtide/nits/pkg/nix"
+)
+
+func TestRollbackTarget(t *testing.T) {
+	generations := []nix.Generation{
+		{Number: 3, Path: "/nix/store/aaa-nixos-system-3"},
+		{Number: 4, Path: "/nix/store/bbb-nixos-system-4"},
+		{Number: 7, Path: "/nix/store/ccc-nixos-system-7", Current: true},
+		{Number: 8, Path: "/nix/store/ddd-nixos-system-8"},
+	}
+
+	tests := []struct {
+		name        string
+		generations []nix.Generation
+		number      int
+		expected    int
+		err         bool
+	}{
+		{name: "previous", generations: generations, number: 0, expected: 4},
+		{name: "older", generations: generations, number: 3, expected: 3},
+		{name: "newer than current", generations: generations, number: 8, expected: 8},
+		{name: "missing", generations: generations, number: 5, err: true},
+		{name: "current", generations: generations, number: 7, err: true},
+		{name: "no previous", generations: generations[2:], number: 0, err: true},
+		{name: "no current", generations: []nix.Generation{{Number: 1}, {Number: 2}}, number: 0, err: true},
+		{name: "none", generations: nil, number: 0, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := rollbackTarget(tt.generations, tt.number)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got generation %d", target.Number)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			} else if target.Number != tt.expected {
+				t.Fatalf("expected generation %d, got %d", tt.expected, target.Number)
+			}
+		})
+	}
+}
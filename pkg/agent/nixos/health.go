@@ -0,0 +1,132 @@
+package nixos
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/juju/errors"
+	"github.com/nix-community/go-nix/pkg/storepath"
+	"github.com/numtide/nits/pkg/nix"
+	"github.com/numtide/nits/pkg/systemd"
+)
+
+const healthCheckInterval = 2 * time.Second
+
+// checkHealth runs the configured health checks until they pass or the health check timeout is reached.
+func (d *deployment) checkHealth(ctx context.Context, l *log.Logger) (err error) {
+	deadline := time.Now().Add(Options.HealthCheckTimeout)
+
+	for {
+		if err = healthCheck(ctx); err == nil {
+			l.Info("health check passed")
+			return
+		} else if time.Now().After(deadline) {
+			return
+		}
+
+		l.Debug("health check failed, retrying", "error", err)
+
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-time.After(healthCheckInterval):
+		}
+	}
+}
+
+func healthCheck(ctx context.Context) error {
+	if Options.HealthCheckFailedUnits {
+		units, err := systemd.FailedUnits(ctx)
+		if err != nil {
+			return errors.Annotate(err, "failed to list failed units")
+		} else if len(units) > 0 {
+			return errors.Errorf("units have failed: %s", strings.Join(units, ", "))
+		}
+	}
+
+	for _, unit := range Options.HealthCheckUnits {
+		active, err := systemd.IsActive(ctx, unit)
+		if err != nil {
+			return errors.Annotatef(err, "failed to check if %s is active", unit)
+		} else if !active {
+			return errors.Errorf("unit is not active: %s", unit)
+		}
+	}
+
+	if Options.HealthCheckCommand != "" {
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", Options.HealthCheckCommand)
+		cmd.Stdout = nix.GetStdOut(ctx)
+		cmd.Stderr = nix.GetStdErr(ctx)
+		if err := cmd.Run(); err != nil {
+			return errors.Annotate(err, "health check command failed")
+		}
+	}
+
+	return nil
+}
+
+// revert rolls back the deployment and records the outcome in the result.
+func (d *deployment) revert(ctx context.Context, l *log.Logger, result *DeployResult) {
+	// we still want to roll back if the deployment has been cancelled or timed out
+	if err := d.rollback(context.WithoutCancel(ctx), l, result); err != nil {
+		l.Error("failed to roll back", "error", err)
+		result.RollbackError = err.Error()
+	} else {
+		l.Info("rollback complete")
+		result.RolledBack = true
+	}
+}
+
+// rollback re-activates the system which was in place before the deployment. For Switch this is the generation of the
+// system profile which was current beforehand, for Test it is the system which was running beforehand. For a profile
+// deployment it is the generation of that profile which was current beforehand.
+func (d *deployment) rollback(ctx context.Context, l *log.Logger, result *DeployResult) (err error) {
+	d.phase.Store(int32(RollingBack))
+	d.save()
+
+	if d.request.Profile != "" {
+		return d.rollbackProfile(ctx, l)
+	}
+
+	var (
+		path    string
+		closure *storepath.StorePath
+	)
+
+	switch d.request.Action {
+	case Switch:
+		if d.previousGeneration > 0 {
+			l.Warn("rolling back to the previous system generation", "generation", d.previousGeneration)
+			err = nix.SwitchGeneration(nix.SystemProfile, d.previousGeneration, ctx)
+		} else {
+			l.Warn("rolling back to the previous system generation")
+			err = nix.RollbackSystem(ctx)
+		}
+
+		if err != nil {
+			return errors.Annotate(err, "failed to roll back system profile")
+		} else if path, err = nix.GetSystemProfile(); err != nil {
+			return
+		}
+	case Test:
+		l.Warn("re-activating the previous system")
+		path = result.PreviousSystem
+	default:
+		return errors.Errorf("%s cannot be rolled back", d.request.Action)
+	}
+
+	if closure, err = storepath.FromAbsolutePath(path); err != nil {
+		return
+	}
+
+	action := "test"
+	if d.request.Action == Switch {
+		action = "switch"
+	}
+
+	l.Info("switching configuration", "action", action, "closure", closure)
+	return nix.Switch(closure, action, ctx)
+}
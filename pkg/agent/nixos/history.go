@@ -0,0 +1,115 @@
+package nixos
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+	"github.com/numtide/nits/pkg/subject"
+)
+
+// Deployment is an entry in the deployment history, combining the record of a deployment with its result.
+type Deployment struct {
+	Id       string
+	NKey     string
+	Started  time.Time
+	Finished time.Time
+
+	Request *DeployRequest
+	// nil if the deployment has not finished
+	Result *DeployResult
+}
+
+// History reads the deployments stream and returns the deployments it contains in descending order by start time.
+// If nkey is empty, the deployments for all agents are returned.
+func History(ctx context.Context, js nats.JetStreamContext, nkey string) (deployments []*Deployment, err error) {
+	subj := subject.AgentDeploymentsAll()
+	if nkey != "" {
+		subj = subject.AgentDeploymentWithNKey(nkey) + ".>"
+	}
+
+	var (
+		sub  *nats.Subscription
+		msg  *nats.Msg
+		meta *nats.MsgMetadata
+		ci   *nats.ConsumerInfo
+	)
+
+	if sub, err = js.SubscribeSync(subj, nats.DeliverAll(), nats.AckNone()); err != nil {
+		return
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	if ci, err = sub.ConsumerInfo(); err != nil {
+		return
+	}
+
+	byId := make(map[string]*Deployment)
+	get := func(id string, agentNKey string) *Deployment {
+		d, ok := byId[id]
+		if !ok {
+			d = &Deployment{Id: id, NKey: agentNKey}
+			byId[id] = d
+			deployments = append(deployments, d)
+		}
+		return d
+	}
+
+	for pending := ci.NumPending; pending > 0; pending = meta.NumPending {
+		if msg, err = sub.NextMsgWithContext(ctx); err != nil {
+			return
+		} else if meta, err = msg.Metadata(); err != nil {
+			return
+		}
+
+		agentNKey := subject.AgentNKeyForSubject(msg.Subject)
+
+		switch {
+		case strings.HasSuffix(msg.Subject, ".REQUEST"):
+			var record DeployRecord
+			if err = json.Unmarshal(msg.Data, &record); err != nil {
+				log.Error("failed to unmarshal deployment record", "subject", msg.Subject, "error", err)
+				continue
+			}
+			d := get(record.Id, agentNKey)
+			d.Request = &record.Request
+			d.Started = meta.Timestamp
+
+		case strings.HasSuffix(msg.Subject, ".RESULT"):
+			var result DeployResult
+			if err = json.Unmarshal(msg.Data, &result); err != nil {
+				log.Error("failed to unmarshal deployment result", "subject", msg.Subject, "error", err)
+				continue
+			}
+			d := get(result.Id, agentNKey)
+			d.Result = &result
+			d.Finished = meta.Timestamp
+		}
+	}
+
+	// unmarshalling errors have already been logged
+	err = nil
+
+	sort.SliceStable(deployments, func(i, j int) bool {
+		return deployments[i].Started.After(deployments[j].Started)
+	})
+
+	return
+}
+
+// FindDeployment returns the deployment with the given id from the history.
+func FindDeployment(deployments []*Deployment, id string) (*Deployment, error) {
+	for _, d := range deployments {
+		if d.Id == id {
+			return d, nil
+		}
+	}
+	return nil, errors.Errorf("no deployment found with id: %s", id)
+}
@@ -0,0 +1,74 @@
+package nixos
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/nats-io/nats.go"
+	nlog "github.com/numtide/nits/pkg/logging"
+	nnats "github.com/numtide/nits/pkg/nats"
+	"github.com/numtide/nits/pkg/nix"
+)
+
+// sessionLogs publishes the logs and output of a long-running operation, such as a deployment, beneath its own subject.
+type sessionLogs struct {
+	sys    *nnats.Writer
+	stdout *nnats.Writer
+	stderr *nnats.Writer
+}
+
+func openLogs(logSubject string) *sessionLogs {
+	return &sessionLogs{
+		sys: &nnats.Writer{
+			Conn:    Conn,
+			Subject: logSubject + ".SYS",
+			Headers: nats.Header{
+				nlog.HeaderFormat: []string{nlog.HeaderLogFmt},
+			},
+		},
+		stdout: &nnats.Writer{
+			Conn:    Conn,
+			Subject: logSubject + ".STDOUT",
+			Headers: nats.Header{
+				nlog.HeaderFormat: []string{nlog.HeaderTerm},
+			},
+		},
+		stderr: &nnats.Writer{
+			Conn:    Conn,
+			Subject: logSubject + ".STDERR",
+			Headers: nats.Header{
+				nlog.HeaderFormat: []string{nlog.HeaderTerm},
+			},
+		},
+	}
+}
+
+// logger returns a logger which writes to the agent's stdout as well as the session.
+func (s *sessionLogs) logger() *log.Logger {
+	l := log.New(io.MultiWriter(os.Stdout, s.sys))
+	l.SetTimeFormat(time.RFC3339)
+	l.SetLevel(log.DebugLevel)
+	l.SetFormatter(log.LogfmtFormatter)
+	l.SetReportTimestamp(true)
+	return l
+}
+
+// context directs the output of any nix commands run with the returned context into the session.
+func (s *sessionLogs) context(ctx context.Context) context.Context {
+	ctx = nix.SetStdOut(ctx, s.stdout)
+	return nix.SetStdError(ctx, s.stdout)
+}
+
+// close ends each of the session's subjects with an end of stream marker.
+func (s *sessionLogs) close() {
+	if err := s.stderr.Close(); err != nil {
+		log.Error("failed to close nats outWriter", "error", err)
+	} else if err := s.stdout.Close(); err != nil {
+		log.Error("failed to close nats outWriter", "error", err)
+	} else if err := s.sys.Close(); err != nil {
+		log.Error("failed to close nats logWriter", "error", err)
+	}
+}
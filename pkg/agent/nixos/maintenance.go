@@ -0,0 +1,153 @@
+package nixos
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/nats-io/nats.go"
+	"github.com/numtide/nits/pkg/maintenance"
+)
+
+// how often to re-evaluate the maintenance windows whilst waiting, in case they have changed
+const windowPollInterval = time.Minute
+
+// the maintenance windows for this agent, cached locally so they are still respected when nats is unreachable
+var windows = atomic.Pointer[maintenance.Windows]{}
+
+func maintenanceWindows() maintenance.Windows {
+	if ws := windows.Load(); ws != nil {
+		return *ws
+	}
+	return nil
+}
+
+func windowsCacheFile() string {
+	if Options.StateDirectory == "" {
+		return ""
+	}
+	return filepath.Join(Options.StateDirectory, "maintenance-windows.json")
+}
+
+func loadMaintenanceWindows() {
+	file := windowsCacheFile()
+	if file == "" {
+		return
+	}
+
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		logger.Error("failed to read cached maintenance windows", "file", file, "error", err)
+		return
+	}
+
+	var ws maintenance.Windows
+	if err = json.Unmarshal(data, &ws); err != nil {
+		logger.Error("failed to unmarshal cached maintenance windows", "file", file, "error", err)
+		return
+	}
+
+	windows.Store(&ws)
+}
+
+func storeMaintenanceWindows(ws maintenance.Windows, data []byte) {
+	windows.Store(&ws)
+
+	file := windowsCacheFile()
+	if file == "" {
+		return
+	}
+
+	var err error
+	if ws == nil {
+		err = os.Remove(file)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	} else {
+		err = os.WriteFile(file, data, 0o600)
+	}
+
+	if err != nil {
+		logger.Error("failed to cache maintenance windows", "file", file, "error", err)
+	}
+}
+
+func watchMaintenanceWindows(ctx context.Context) (err error) {
+	var (
+		js      nats.JetStreamContext
+		kv      nats.KeyValue
+		watcher nats.KeyWatcher
+	)
+
+	if js, err = Conn.JetStream(); err != nil {
+		return
+	} else if kv, err = js.KeyValue(maintenance.Bucket); err != nil {
+		return
+	} else if watcher, err = kv.Watch(NKey, nats.Context(ctx)); err != nil {
+		return
+	}
+
+	go func() {
+		for entry := range watcher.Updates() {
+			// a nil entry indicates we have caught up with the current value
+			if entry == nil {
+				continue
+			}
+
+			if entry.Operation() != nats.KeyValuePut {
+				logger.Info("maintenance windows removed", "revision", entry.Revision())
+				storeMaintenanceWindows(nil, nil)
+				continue
+			}
+
+			var ws maintenance.Windows
+			if err := json.Unmarshal(entry.Value(), &ws); err != nil {
+				logger.Error("failed to unmarshal maintenance windows", "revision", entry.Revision(), "error", err)
+				continue
+			}
+
+			logger.Info("maintenance windows received", "revision", entry.Revision(), "windows", ws)
+			storeMaintenanceWindows(ws, entry.Value())
+		}
+	}()
+
+	return
+}
+
+// awaitWindow blocks until a maintenance window is open. The deploy timeout does not apply whilst waiting.
+func (d *deployment) awaitWindow(ctx context.Context, l *log.Logger) error {
+	remaining := d.pauseTimeout()
+	defer d.resumeTimeout(remaining)
+
+	var waitingFor time.Time
+
+	for {
+		now := time.Now()
+		start, end, ok := maintenanceWindows().Next(now)
+		if !ok {
+			l.Info("maintenance windows have been removed")
+			return nil
+		} else if !start.After(now) {
+			l.Info("maintenance window is open", "until", end)
+			return nil
+		}
+
+		if !start.Equal(waitingFor) {
+			l.Info("waiting for maintenance window", "start", start, "end", end)
+			waitingFor = start
+		}
+
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-time.After(min(time.Until(start), windowPollInterval)):
+		}
+	}
+}
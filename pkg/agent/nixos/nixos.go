@@ -4,25 +4,45 @@ import (
 	"context"
 
 	"github.com/charmbracelet/log"
+	"github.com/juju/errors"
+	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/micro"
+	"github.com/nix-community/go-nix/pkg/narinfo/signature"
 	"github.com/numtide/nits/pkg/agent/util"
+	"github.com/numtide/nits/pkg/cache"
+	"github.com/numtide/nits/pkg/maintenance"
 	"github.com/numtide/nits/pkg/subject"
 )
 
 var (
-	NKey string
-	Conn *nats.Conn
+	NKey   string
+	Conn   *nats.Conn
+	Claims *jwt.UserClaims
 
 	logger *log.Logger
+
+	// closures must be signed by one of these keys before they are activated, if any are configured
+	trustedKeys []signature.PublicKey
 )
 
 func Init(ctx context.Context) (err error) {
 	Conn = util.GetConn(ctx)
 	NKey = util.GetNKey(ctx)
+	Claims = util.GetClaims(ctx)
 
 	logger = log.Default().With("service", "nixos")
 
+	if trustedKeys, err = cache.ParsePublicKeys(Options.TrustedPublicKeys); err != nil {
+		return
+	}
+
+	// fall back to the cached maintenance windows until we hear otherwise, a recovered deployment may be waiting on them
+	loadMaintenanceWindows()
+
+	// finalise any deployment we were in the middle of before accepting new ones
+	recoverDeployment()
+
 	var srv micro.Service
 	if srv, err = micro.AddService(Conn, micro.Config{
 		Name:        "AgentNixos",
@@ -34,7 +54,53 @@ func Init(ctx context.Context) (err error) {
 
 	group := srv.AddGroup(subject.AgentService(NKey, "NIXOS"))
 
-	currentDeployId.Store("")
+	if err = group.AddEndpoint("DEPLOY", micro.HandlerFunc(onDeploy)); err != nil {
+		return
+	} else if err = group.AddEndpoint(
+		"DEPLOY_CANCEL", micro.HandlerFunc(onCancel), micro.WithEndpointSubject("DEPLOY.CANCEL"),
+	); err != nil {
+		return
+	} else if err = group.AddEndpoint("STATUS", micro.HandlerFunc(onStatus)); err != nil {
+		return
+	} else if err = group.AddEndpoint("PLAN", micro.HandlerFunc(onPlan)); err != nil {
+		return
+	} else if err = group.AddEndpoint("GENERATIONS", micro.HandlerFunc(onGenerations)); err != nil {
+		return
+	} else if err = group.AddEndpoint(
+		"GENERATIONS_DELETE", micro.HandlerFunc(onDeleteGenerations), micro.WithEndpointSubject("GENERATIONS.DELETE"),
+	); err != nil {
+		return
+	} else if err = group.AddEndpoint("ROLLBACK", micro.HandlerFunc(onRollback)); err != nil {
+		return
+	}
+
+	nixGroup := srv.AddGroup(subject.AgentService(NKey, "NIX"))
+
+	if err = nixGroup.AddEndpoint("GC", micro.HandlerFunc(onGc)); err != nil {
+		return
+	}
+
+	// a missing bucket should not prevent live deployments
+	if err = watchDesiredState(ctx); err != nil {
+		logger.Warn("failed to watch desired state", "bucket", DesiredStateBucket, "error", err)
+		err = nil
+	}
+
+	if err = watchMaintenanceWindows(ctx); err != nil {
+		logger.Warn("failed to watch maintenance windows", "bucket", maintenance.Bucket, "error", err)
+		err = nil
+	}
+
+	if Options.GcThreshold > 0 {
+		if Options.GcTarget >= Options.GcThreshold {
+			return errors.Errorf(
+				"gc target (%d%%) must be less than the gc threshold (%d%%)", Options.GcTarget, Options.GcThreshold,
+			)
+		} else if Options.GcInterval <= 0 {
+			return errors.Errorf("gc interval must be positive: %s", Options.GcInterval)
+		}
+		go autoGc(ctx)
+	}
 
-	return group.AddEndpoint("DEPLOY", micro.HandlerFunc(onDeploy))
+	return
 }
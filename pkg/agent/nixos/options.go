@@ -0,0 +1,32 @@
+package nixos
+
+import "time"
+
+// Options configures the behaviour of the nixos service, it is expected to be set before Init is called.
+var Options = &CliOptions{}
+
+type CliOptions struct {
+	DeployTimeout time.Duration `env:"DEPLOY_TIMEOUT" default:"0s" help:"Maximum duration of a deployment, excluding time spent waiting for a maintenance window or activating, zero means no limit."`
+
+	StateDirectory string `env:"STATE_DIRECTORY" help:"Directory in which the agent keeps state between restarts."`
+
+	ServiceUnit string `env:"SERVICE_UNIT" default:"nits-agent.service" help:"The systemd unit which runs the agent, used to restart it once a deployment changes its executable."`
+
+	TrustedPublicKeys []string `env:"TRUSTED_PUBLIC_KEYS" help:"Public keys in the form <name>:<base64 key>, if set every path in a closure must be signed by one of them before it is activated."`
+
+	ConfirmTimeout time.Duration `env:"CONFIRM_TIMEOUT" default:"2m" help:"How long to wait for connectivity to be confirmed after activation before rolling back, zero disables this."`
+
+	HealthCheckFailedUnits bool          `env:"HEALTH_CHECK_FAILED_UNITS" help:"Fail the health check after activation if any systemd units have failed."`
+	HealthCheckUnits       []string      `env:"HEALTH_CHECK_UNITS" help:"Systemd units which must be active after activation."`
+	HealthCheckCommand     string        `env:"HEALTH_CHECK_COMMAND" help:"A shell command which must exit successfully after activation."`
+	HealthCheckTimeout     time.Duration `env:"HEALTH_CHECK_TIMEOUT" default:"30s" help:"How long to wait for the health checks to pass before rolling back."`
+
+	GcThreshold       int           `env:"GC_THRESHOLD" default:"0" help:"Collect garbage automatically once the file system holding the nix store is more than this percentage full, zero disables this."`
+	GcTarget          int           `env:"GC_TARGET" default:"0" help:"When collecting garbage automatically, stop once the file system is no more than this percentage full, zero collects all garbage."`
+	GcKeepGenerations int           `env:"GC_KEEP_GENERATIONS" default:"0" help:"When collecting garbage automatically, delete all but this many of the most recent system generations first, zero keeps them all."`
+	GcInterval        time.Duration `env:"GC_INTERVAL" default:"10m" help:"How often to check the disk usage of the nix store when collecting garbage automatically."`
+}
+
+func (o *CliOptions) healthChecksEnabled() bool {
+	return o.HealthCheckFailedUnits || len(o.HealthCheckUnits) > 0 || o.HealthCheckCommand != ""
+}
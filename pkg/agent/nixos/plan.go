@@ -0,0 +1,145 @@
+package nixos
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/nix-community/go-nix/pkg/storepath"
+	nnats "github.com/numtide/nits/pkg/nats"
+	"github.com/numtide/nits/pkg/nix"
+	"github.com/numtide/nits/pkg/subject"
+)
+
+type PlanRequest struct {
+	Closure string `json:"closure"`
+	// name of an object store from which to fetch any store paths missing from the agent's nix store
+	Cache string `json:"cache,omitempty"`
+	// who requested the plan, set by the agent from the request's signature
+	Issuer string `json:"issuer,omitempty"`
+}
+
+type PlanResponse struct {
+	CurrentSystem string `json:"current-system"`
+	// packages whose versions differ between the current system and the closure
+	Packages []nix.PackageChange `json:"packages,omitempty"`
+	// what switching to the closure would do
+	Activation nix.DryActivation `json:"activation"`
+}
+
+func onPlan(req micro.Request) {
+	var (
+		err     error
+		request PlanRequest
+		closure *storepath.StorePath
+	)
+
+	if err = json.Unmarshal(req.Data(), &request); err != nil {
+		_ = req.Error("400", fmt.Sprintf("Failed to unmarshal request: %s", err), nil)
+		return
+	} else if closure, err = storepath.FromAbsolutePath(request.Closure); err != nil {
+		_ = req.Error("400", fmt.Sprintf("Malformed closure: %s", err), nil)
+		return
+	} else if request.Issuer, err = nnats.RequestIssuer(req, Claims); err != nil {
+		_ = req.Error("401", fmt.Sprintf("Failed to verify issuer: %s", err), nil)
+		return
+	}
+
+	// building and dry activating alongside a deployment or garbage collection would race with it
+	slot, ok := reserve("planning")
+	if !ok {
+		_ = req.Error("417", "A deployment is in progress.", nil)
+		return
+	}
+
+	// realising the closure can take a while, so we respond in the background rather than hold up other requests
+	go func() {
+		defer slot.release()
+
+		response, err := plan(context.Background(), request, closure)
+		if err != nil {
+			_ = req.Error("500", err.Error(), nil)
+			return
+		}
+
+		if err = req.RespondJSON(response); err != nil {
+			logger.Error("failed to respond", "error", err)
+		}
+	}()
+}
+
+// plan realises the closure and determines how switching to it would change the running system.
+func plan(ctx context.Context, request PlanRequest, closure *storepath.StorePath) (response PlanResponse, err error) {
+	// capture the output of nix so that we can parse it
+	var output bytes.Buffer
+	ctx = nix.SetStdOut(ctx, &output)
+	ctx = nix.SetStdError(ctx, &output)
+
+	l := logger.With("closure", closure, "issuer", request.Issuer)
+
+	if request.Cache != "" {
+		if err = fetchClosure(ctx, l, request.Cache, closure); err != nil {
+			return response, errors.Annotate(err, "failed to fetch closure")
+		}
+	}
+
+	l.Info("building closure for plan")
+	if err = nix.Build(closure, nil, ctx); err != nil {
+		return response, errors.Annotatef(err, "failed to build closure: %s", lastLines(output.String(), 10))
+	}
+
+	if len(trustedKeys) > 0 {
+		// dry activation runs code from the closure, so it must be trusted as much as a deployment
+		l.Info("verifying closure signatures", "keys", len(trustedKeys))
+		if err = verifyClosure(closure, 0); err != nil {
+			return response, errors.Annotate(err, "failed to verify closure")
+		}
+	}
+
+	var before, after []nix.PathInfo
+	if response.CurrentSystem, err = nix.GetSystem(); err != nil {
+		return response, errors.Annotate(err, "failed to determine current system")
+	} else if before, err = nix.QueryPathInfo(true, response.CurrentSystem); err != nil {
+		return response, errors.Annotate(err, "failed to query current system closure")
+	} else if after, err = nix.QueryPathInfo(true, closure.Absolute()); err != nil {
+		return response, errors.Annotate(err, "failed to query closure")
+	}
+
+	response.Packages = nix.DiffClosures(storePaths(before), storePaths(after))
+
+	output.Reset()
+
+	l.Info("dry activating closure for plan")
+	if response.Activation, err = nix.DryActivate(closure, ctx); err != nil {
+		return response, errors.Annotatef(err, "failed to dry activate closure: %s", lastLines(output.String(), 10))
+	}
+
+	return
+}
+
+func storePaths(infos []nix.PathInfo) []string {
+	paths := make([]string, len(infos))
+	for idx, info := range infos {
+		paths[idx] = info.Path
+	}
+	return paths
+}
+
+// lastLines returns the last n lines of the given output, for inclusion in error messages.
+func lastLines(output string, n int) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func PlanWithContext(ctx context.Context, conn *nats.EncodedConn, nkey string, req PlanRequest) (resp PlanResponse, err error) {
+	err = nnats.RequestWithContext(ctx, conn, subject.AgentService(nkey, "NIXOS.PLAN"), req, &resp)
+	return
+}
@@ -0,0 +1,93 @@
+package nixos
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/juju/errors"
+	"github.com/nix-community/go-nix/pkg/storepath"
+	"github.com/numtide/nits/pkg/nix"
+)
+
+// activateProfile sets the requested profile to the closure and runs its activation script, if any.
+func (d *deployment) activateProfile(ctx context.Context, l *log.Logger, closure *storepath.StorePath, result *DeployResult) (err error) {
+	request := d.request
+
+	var remaining time.Duration
+	if remaining, err = d.beginActivation(ctx); err != nil {
+		return
+	}
+	defer d.endActivation(remaining)
+
+	d.enter(SettingSystem, result)
+
+	// a new profile has no generations to return to
+	if _, err = os.Lstat(request.Profile); err == nil {
+		if d.previousGeneration, err = nix.CurrentGeneration(request.Profile); err != nil {
+			l.Warn("failed to determine current generation", "profile", request.Profile, "error", err)
+		}
+	}
+	err = nil
+
+	// persist the previous generation before changing the profile
+	d.save()
+
+	l.Info("setting profile", "profile", request.Profile)
+	if err = nix.SetProfile(request.Profile, closure, ctx); err != nil {
+		l.Error("failed to set profile", "error", err)
+		return
+	}
+
+	if request.Activate == "" {
+		return
+	}
+
+	d.enter(Switching, result)
+	l.Info("running activation script", "script", request.Activate, "user", request.User)
+	if err = nix.RunActivation(closure, request.Activate, request.User, ctx); err != nil {
+		l.Error("failed to run activation script", "error", err)
+		d.revert(ctx, l, result)
+	}
+
+	return
+}
+
+// rollbackProfile returns the requested profile to the generation which was current before the deployment and
+// re-runs its activation script. A profile which did not exist beforehand is left as it is.
+func (d *deployment) rollbackProfile(ctx context.Context, l *log.Logger) (err error) {
+	request := d.request
+
+	if d.previousGeneration == 0 {
+		return errors.Errorf("profile %s had no previous generation", request.Profile)
+	}
+
+	l.Warn("rolling back to the previous profile generation", "profile", request.Profile, "generation", d.previousGeneration)
+	if err = nix.SwitchGeneration(request.Profile, d.previousGeneration, ctx); err != nil {
+		return errors.Annotate(err, "failed to roll back profile")
+	}
+
+	if request.Activate == "" {
+		return
+	}
+
+	var (
+		path    string
+		closure *storepath.StorePath
+	)
+
+	if path, err = nix.GetProfile(request.Profile); err != nil {
+		return
+	} else if closure, err = storepath.FromAbsolutePath(path); err != nil {
+		return
+	}
+
+	if _, err = os.Stat(closure.Absolute() + "/" + request.Activate); os.IsNotExist(err) {
+		l.Warn("previous generation has no activation script", "script", request.Activate)
+		return nil
+	}
+
+	l.Info("running activation script", "closure", closure, "script", request.Activate, "user", request.User)
+	return nix.RunActivation(closure, request.Activate, request.User, ctx)
+}
@@ -0,0 +1,196 @@
+package nixos
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/juju/errors"
+	"github.com/nix-community/go-nix/pkg/storepath"
+)
+
+const ErrDeploymentInterrupted = errors.ConstError("deployment was interrupted by the agent restarting")
+
+// deploymentState is persisted whilst a deployment is in progress, so that it can be finalised should the agent be
+// restarted before the deployment has finished.
+type deploymentState struct {
+	Id                 string        `json:"id"`
+	Logs               string        `json:"logs"`
+	Request            DeployRequest `json:"request"`
+	Started            time.Time     `json:"started"`
+	Phase              DeployPhase   `json:"phase"`
+	PreviousSystem     string        `json:"previous-system"`
+	PreviousGeneration int           `json:"previous-generation,omitempty"`
+}
+
+func deploymentStateFile() string {
+	if Options.StateDirectory == "" {
+		return ""
+	}
+	return filepath.Join(Options.StateDirectory, "deployment.json")
+}
+
+// save persists the deployment's state, replacing the previous state in a single step so that a restart can never
+// leave it half written.
+func (d *deployment) save() {
+	file := deploymentStateFile()
+	if file == "" {
+		return
+	}
+
+	data, err := json.Marshal(deploymentState{
+		Id:                 d.id,
+		Logs:               d.logs,
+		Request:            d.request,
+		Started:            d.started,
+		Phase:              DeployPhase(d.phase.Load()),
+		PreviousSystem:     d.previousSystem,
+		PreviousGeneration: d.previousGeneration,
+	})
+	if err != nil {
+		logger.Error("failed to marshal deployment state", "error", err)
+		return
+	}
+
+	tmp := file + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		logger.Error("failed to write deployment state", "file", tmp, "error", err)
+	} else if err = os.Rename(tmp, file); err != nil {
+		logger.Error("failed to write deployment state", "file", file, "error", err)
+	}
+}
+
+func (d *deployment) clearState() {
+	file := deploymentStateFile()
+	if file == "" {
+		return
+	}
+
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		logger.Error("failed to remove deployment state", "file", file, "error", err)
+	}
+}
+
+func loadDeploymentState() (*deploymentState, error) {
+	file := deploymentStateFile()
+	if file == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "failed to read deployment state: %s", file)
+	}
+
+	var state deploymentState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, errors.Annotatef(err, "failed to unmarshal deployment state: %s", file)
+	}
+
+	return &state, nil
+}
+
+// recoverDeployment finalises a deployment which was in progress when the agent last stopped, publishing its result
+// and closing its logs.
+func recoverDeployment() {
+	state, err := loadDeploymentState()
+	if err != nil {
+		logger.Error("failed to recover deployment", "error", err)
+		return
+	} else if state == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	d := &deployment{
+		id:                 state.Id,
+		logs:               state.Logs,
+		request:            state.Request,
+		started:            state.Started,
+		cancel:             cancel,
+		previousSystem:     state.PreviousSystem,
+		previousGeneration: state.PreviousGeneration,
+	}
+	d.phase.Store(int32(state.Phase))
+
+	// nothing else can be running this early, but deployments should still be refused until we are done
+	currentDeployment.Store(d)
+
+	logger.Info("recovering deployment", "id", d.id, "phase", state.Phase)
+	go d.execute(ctx, d.resume)
+}
+
+// resume picks up a deployment from the phase it was in when the agent stopped. A closure which was staged whilst
+// waiting for a maintenance window carries on waiting and is then activated. Anything else before activation is
+// abandoned, since it is safe to deploy again. If the closure had been activated, we carry on checking it as usual. If
+// activation or a rollback was interrupted, we cannot tell how far it got, so we return to the previous system.
+func (d *deployment) resume(ctx context.Context, l *log.Logger, result *DeployResult) (err error) {
+	phase := DeployPhase(d.phase.Load())
+	action := d.request.Action
+
+	l.Warn("resuming deployment after the agent restarted", "phase", phase, "action", action)
+
+	switch phase {
+	case Staging, AwaitingWindow:
+		if action == Stage {
+			return d.resumeStage(l)
+		}
+		// the closure has been built and verified, it was only waiting to be activated
+		return d.resumeActivation(ctx, l, result)
+	case Confirming, CheckingHealth:
+		return d.check(ctx, l, result)
+	case Switching, SettingSystem, RollingBack:
+		if action == Switch || action == Test {
+			d.revert(ctx, l, result)
+		}
+		return ErrDeploymentInterrupted
+	default:
+		// nothing had been activated
+	}
+
+	var current string
+	if current, err = currentSystem(d.request); err != nil {
+		return
+	} else if current != d.request.Closure {
+		return ErrDeploymentInterrupted
+	}
+
+	l.Info("closure is already in place")
+	return nil
+}
+
+// resumeStage reports whether a deployment with the Stage action managed to add its GC root before the agent stopped.
+func (d *deployment) resumeStage(l *log.Logger) error {
+	staged, err := stagedClosure(d.request)
+	if err != nil {
+		return err
+	} else if staged != d.request.Closure {
+		return ErrDeploymentInterrupted
+	}
+
+	l.Info("closure has been staged")
+	return nil
+}
+
+// resumeActivation activates a closure which was staged until a maintenance window opened, waiting for the window
+// again if it is still closed.
+func (d *deployment) resumeActivation(ctx context.Context, l *log.Logger, result *DeployResult) (err error) {
+	var (
+		closure *storepath.StorePath
+		staged  string
+	)
+
+	if closure, err = storepath.FromAbsolutePath(d.request.Closure); err != nil {
+		return
+	} else if staged, err = stagedClosure(d.request); err != nil {
+		l.Warn("failed to determine staged closure", "error", err)
+	}
+
+	return d.activate(ctx, l, closure, result, staged)
+}
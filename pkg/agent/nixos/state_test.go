@@ -0,0 +1,66 @@
+package nixos
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeploymentState(t *testing.T) {
+	previous := Options.StateDirectory
+	Options.StateDirectory = t.TempDir()
+	t.Cleanup(func() {
+		Options.StateDirectory = previous
+	})
+
+	if state, err := loadDeploymentState(); err != nil {
+		t.Fatal(err)
+	} else if state != nil {
+		t.Fatalf("expected no state, got %+v", state)
+	}
+
+	d := &deployment{
+		id:   "abc",
+		logs: "NITS.AGENT.ABC.LOG.NIXOS.DEPLOY.abc",
+		request: DeployRequest{
+			Action:  Switch,
+			Closure: "/nix/store/bbb-nixos-system-8",
+			Issuer:  "admin",
+			Force:   true,
+		},
+		started:            time.Date(2024, 6, 2, 3, 0, 0, 0, time.UTC),
+		previousSystem:     "/nix/store/aaa-nixos-system-7",
+		previousGeneration: 7,
+	}
+
+	for _, phase := range []DeployPhase{Staging, AwaitingWindow, Confirming} {
+		d.phase.Store(int32(phase))
+		d.save()
+
+		state, err := loadDeploymentState()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := &deploymentState{
+			Id:                 d.id,
+			Logs:               d.logs,
+			Request:            d.request,
+			Started:            d.started,
+			Phase:              phase,
+			PreviousSystem:     d.previousSystem,
+			PreviousGeneration: d.previousGeneration,
+		}
+		if !reflect.DeepEqual(state, expected) {
+			t.Fatalf("expected %+v, got %+v", expected, state)
+		}
+	}
+
+	d.clearState()
+
+	if state, err := loadDeploymentState(); err != nil {
+		t.Fatal(err)
+	} else if state != nil {
+		t.Fatalf("expected the state to be cleared, got %+v", state)
+	}
+}
@@ -0,0 +1,74 @@
+package nixos
+
+import (
+	"context"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/numtide/nits/pkg/maintenance"
+	nnats "github.com/numtide/nits/pkg/nats"
+	"github.com/numtide/nits/pkg/nix"
+	"github.com/numtide/nits/pkg/subject"
+)
+
+type StatusResponse struct {
+	// nil if there is no deployment in progress
+	Deployment *DeploymentStatus `json:"deployment,omitempty"`
+	// the system closure which has been staged for activation, if any
+	Staged string `json:"staged,omitempty"`
+	// the maintenance windows in which activations are allowed, activation is unrestricted if there are none
+	MaintenanceWindows maintenance.Windows `json:"maintenance-windows,omitempty"`
+	// the next maintenance window, or the current one if it is open
+	NextWindow *MaintenanceWindow `json:"next-window,omitempty"`
+}
+
+type MaintenanceWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+type DeploymentStatus struct {
+	Id      string        `json:"id"`
+	Logs    string        `json:"logs"`
+	Result  string        `json:"result"`
+	Phase   DeployPhase   `json:"phase"`
+	Started time.Time     `json:"started"`
+	Request DeployRequest `json:"request"`
+}
+
+func onStatus(req micro.Request) {
+	var (
+		err      error
+		response StatusResponse
+	)
+
+	if response.Staged, err = nix.GetStagedSystem(); err != nil {
+		logger.Warn("failed to determine staged system", "error", err)
+	}
+
+	response.MaintenanceWindows = maintenanceWindows()
+	if start, end, ok := response.MaintenanceWindows.Next(time.Now()); ok {
+		response.NextWindow = &MaintenanceWindow{Start: start, End: end}
+	}
+
+	if d := currentDeployment.Load(); d != nil && d.operation == "" {
+		response.Deployment = &DeploymentStatus{
+			Id:      d.id,
+			Logs:    d.logs,
+			Result:  subject.AgentDeploymentResult(NKey, d.id),
+			Phase:   DeployPhase(d.phase.Load()),
+			Started: d.started,
+			Request: d.request,
+		}
+	}
+
+	if err = req.RespondJSON(response); err != nil {
+		logger.Error("failed to respond", "error", err)
+	}
+}
+
+func StatusWithContext(ctx context.Context, conn *nats.EncodedConn, nkey string) (resp StatusResponse, err error) {
+	err = nnats.RequestWithContext(ctx, conn, subject.AgentService(nkey, "NIXOS.STATUS"), struct{}{}, &resp)
+	return
+}
@@ -0,0 +1,109 @@
+package nixos
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/juju/errors"
+)
+
+// how long to wait for pending messages to be flushed before restarting
+const drainTimeout = 30 * time.Second
+
+// upgradeTarget returns the agent executable started by the deployed system if it differs from the one which is
+// running, or an empty string if the agent does not need to restart.
+func (d *deployment) upgradeTarget(l *log.Logger) string {
+	if d.request.Action != Switch || d.request.Profile != "" {
+		return ""
+	}
+
+	running, err := os.Executable()
+	if err == nil {
+		running, err = filepath.EvalSymlinks(running)
+	}
+	if err != nil {
+		l.Warn("failed to determine the agent's executable", "error", err)
+		return ""
+	}
+
+	// the unit may refer to the executable through a symlink e.g. /run/current-system/sw/bin, so it must be resolved in
+	// the same way as the running executable before they can be compared
+	deployed, err := unitExecutable(d.request.Closure, Options.ServiceUnit)
+	if err == nil {
+		deployed, err = filepath.EvalSymlinks(deployed)
+	}
+	if err != nil {
+		l.Warn("failed to determine the agent's executable in the new system", "unit", Options.ServiceUnit, "error", err)
+		return ""
+	} else if deployed == running {
+		return ""
+	}
+
+	l.Info("agent executable has changed, the agent will restart", "running", running, "deployed", deployed)
+	return deployed
+}
+
+// unitExecutable returns the executable from the ExecStart line of a systemd unit within the given system closure.
+func unitExecutable(system string, unit string) (string, error) {
+	file, err := os.Open(filepath.Join(system, "etc/systemd/system", unit))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "ExecStart=")
+		if !ok {
+			continue
+		}
+
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// ignore any special executable prefixes such as - or +
+		return strings.TrimLeft(fields[0], "@-:+!"), nil
+	}
+
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", errors.Errorf("no ExecStart in unit: %s", unit)
+}
+
+// restart drains the nats connection and then restarts the agent with the given executable, either by asking systemd to
+// restart its unit or, when not running under systemd, by re-executing it in place.
+func restart(executable string) {
+	logger.Info("draining nats connection before restarting")
+
+	if err := Conn.Drain(); err != nil {
+		logger.Error("failed to drain nats connection", "error", err)
+	}
+
+	deadline := time.Now().Add(drainTimeout)
+	for !Conn.IsClosed() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	var err error
+	if os.Getenv("INVOCATION_ID") != "" {
+		// systemd will stop us as part of the restart, so we must not wait for it to complete
+		err = exec.Command("systemctl", "restart", "--no-block", Options.ServiceUnit).Run()
+	} else {
+		err = syscall.Exec(executable, append([]string{executable}, os.Args[1:]...), os.Environ())
+	}
+
+	if err != nil {
+		// we are no longer connected, so exit and rely on being restarted
+		log.Fatal("failed to restart agent", "executable", executable, "error", err)
+	}
+}
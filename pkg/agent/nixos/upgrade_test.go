@@ -0,0 +1,55 @@
+package nixos
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnitExecutable(t *testing.T) {
+	const agent = "/nix/store/aaa-nits-agent/bin/nits-agent"
+
+	tests := []struct {
+		name     string
+		unit     string
+		expected string
+		err      bool
+	}{
+		{name: "plain", unit: "[Service]\nExecStart=" + agent + " --log-level info\n", expected: agent},
+		{name: "ignore failure", unit: "[Service]\nExecStart=-" + agent + "\n", expected: agent},
+		{name: "argv0", unit: "[Service]\nExecStart=@" + agent + " nits-agent\n", expected: agent},
+		{name: "privileged", unit: "[Service]\nExecStart=+" + agent + "\n", expected: agent},
+		{name: "combined prefixes", unit: "[Service]\nExecStart=-!" + agent + "\n", expected: agent},
+		{name: "indented", unit: "[Service]\n  ExecStart=" + agent + "\n", expected: agent},
+		{name: "reset first", unit: "[Service]\nExecStart=\nExecStart=" + agent + "\n", expected: agent},
+		{name: "missing ExecStart", unit: "[Service]\nType=simple\n", err: true},
+		{name: "empty ExecStart", unit: "[Service]\nExecStart=\n", err: true},
+		{name: "missing unit", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			system := t.TempDir()
+			if tt.unit != "" {
+				dir := filepath.Join(system, "etc/systemd/system")
+				if err := os.MkdirAll(dir, 0o755); err != nil {
+					t.Fatal(err)
+				} else if err = os.WriteFile(filepath.Join(dir, "nits-agent.service"), []byte(tt.unit), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			executable, err := unitExecutable(system, "nits-agent.service")
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", executable)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			} else if executable != tt.expected {
+				t.Fatalf("expected %s, got %s", tt.expected, executable)
+			}
+		})
+	}
+}
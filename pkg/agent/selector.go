@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/numtide/nits/pkg/agent/info"
+)
+
+// Selector matches agents whose labels contain all of its key value pairs.
+type Selector map[string]string
+
+// ParseSelector parses a selector in the form key=value,key=value. Labels are case-insensitive, see info.LabelTags, so
+// the selector is lowercased.
+func ParseSelector(str string) (selector Selector, err error) {
+	selector = make(Selector)
+	if str == "" {
+		return
+	}
+
+	for _, term := range strings.Split(str, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(term), "=")
+		if !ok || key == "" {
+			return nil, errors.Errorf("malformed selector term: %s", term)
+		}
+		selector[strings.ToLower(key)] = strings.ToLower(value)
+	}
+
+	return
+}
+
+// Matches returns true if labels contain every key value pair in the selector. An empty selector matches everything.
+func (s Selector) Matches(labels map[string]string) bool {
+	for key, value := range s {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Select returns the agents which match the selector.
+func Select(agents []*info.Response, selector Selector) (selected []*info.Response) {
+	for _, a := range agents {
+		if selector.Matches(a.Labels) {
+			selected = append(selected, a)
+		}
+	}
+	return
+}
@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/numtide/nits/pkg/agent/info"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected Selector
+		err      bool
+	}{
+		{name: "empty", input: "", expected: Selector{}},
+		{name: "single", input: "site=oslo", expected: Selector{"site": "oslo"}},
+		{
+			name:     "multiple",
+			input:    "site=oslo, role=gateway",
+			expected: Selector{"site": "oslo", "role": "gateway"},
+		},
+		{name: "empty value", input: "site=", expected: Selector{"site": ""}},
+		{name: "value containing separator", input: "url=a=b", expected: Selector{"url": "a=b"}},
+		{name: "lowercased", input: "Site=Oslo", expected: Selector{"site": "oslo"}},
+		{name: "missing separator", input: "site", err: true},
+		{name: "missing key", input: "=oslo", err: true},
+		{name: "empty term", input: "site=oslo,", err: true},
+		{name: "only a comma", input: ",", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selector, err := ParseSelector(tt.input)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", selector)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			} else if !reflect.DeepEqual(selector, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, selector)
+			}
+		})
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	labels := map[string]string{"site": "oslo", "role": "gateway"}
+
+	tests := []struct {
+		name     string
+		selector string
+		labels   map[string]string
+		expected bool
+	}{
+		{name: "empty selector", selector: "", labels: labels, expected: true},
+		{name: "empty selector without labels", selector: "", labels: nil, expected: true},
+		{name: "single match", selector: "site=oslo", labels: labels, expected: true},
+		{name: "all match", selector: "site=oslo,role=gateway", labels: labels, expected: true},
+		{name: "one mismatch", selector: "site=oslo,role=db", labels: labels, expected: false},
+		{name: "missing key", selector: "rack=1", labels: labels, expected: false},
+		{name: "without labels", selector: "site=oslo", labels: nil, expected: false},
+		{name: "empty value", selector: "site=", labels: labels, expected: false},
+		{name: "case insensitive", selector: "SITE=Oslo", labels: labels, expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selector, err := ParseSelector(tt.selector)
+			if err != nil {
+				t.Fatal(err)
+			} else if matches := selector.Matches(tt.labels); matches != tt.expected {
+				t.Fatalf("expected %v, got %v", tt.expected, matches)
+			}
+		})
+	}
+}
+
+func TestSelect(t *testing.T) {
+	agents := []*info.Response{
+		{Name: "a", Labels: map[string]string{"site": "oslo"}},
+		{Name: "b", Labels: map[string]string{"site": "berlin"}},
+		{Name: "c", Labels: map[string]string{"site": "oslo", "role": "gateway"}},
+	}
+
+	selector, err := ParseSelector("site=oslo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, a := range Select(agents, selector) {
+		names = append(names, a.Name)
+	}
+
+	if expected := []string{"a", "c"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+}
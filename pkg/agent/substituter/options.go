@@ -0,0 +1,8 @@
+package substituter
+
+// Options configures the behaviour of the substituter, it is expected to be set before Init is called.
+var Options = &CliOptions{}
+
+type CliOptions struct {
+	SubstituterAddress string `env:"SUBSTITUTER_ADDRESS" help:"Address on which to serve a binary cache backed by NATS e.g. 127.0.0.1:5555, disabled if empty."`
+}
@@ -0,0 +1,132 @@
+package substituter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+	"github.com/nix-community/go-nix/pkg/storepath"
+	"github.com/numtide/nits/pkg/agent/util"
+	"github.com/numtide/nits/pkg/cache"
+	nnats "github.com/numtide/nits/pkg/nats"
+)
+
+var (
+	Conn *nats.EncodedConn
+
+	logger *log.Logger
+)
+
+// Init starts a binary cache on the configured address which answers requests by querying the cache service over
+// NATS, allowing the local nix daemon to use it as a substituter.
+func Init(ctx context.Context) (err error) {
+	if Options.SubstituterAddress == "" {
+		return
+	}
+
+	logger = log.Default().With("service", "substituter")
+
+	if Conn, err = nats.NewEncodedConn(util.GetConn(ctx), nats.JSON_ENCODER); err != nil {
+		return
+	}
+
+	var listener net.Listener
+	if listener, err = net.Listen("tcp", Options.SubstituterAddress); err != nil {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nix-cache-info", onCacheInfo)
+	mux.HandleFunc("/nar/", onNar)
+	mux.HandleFunc("/", onNarInfo)
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("substituter stopped", "error", err)
+		}
+	}()
+
+	context.AfterFunc(ctx, func() {
+		_ = server.Close()
+	})
+
+	logger.Info("substituter listening", "address", listener.Addr())
+	return
+}
+
+func onCacheInfo(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/x-nix-cache-info")
+	_, _ = fmt.Fprintf(w, "StoreDir: %s\nWantMassQuery: 1\nPriority: 50\n", storepath.StoreDir)
+}
+
+func onNarInfo(w http.ResponseWriter, r *http.Request) {
+	hashPart, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".narinfo")
+	if !ok || strings.Contains(hashPart, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	resp, err := cache.NarInfoWithContext(r.Context(), Conn, hashPart)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/x-nix-narinfo")
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp.NarInfo)))
+
+	if r.Method != http.MethodHead {
+		_, _ = w.Write([]byte(resp.NarInfo))
+	}
+}
+
+func onNar(w http.ResponseWriter, r *http.Request) {
+	hashPart, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/nar/"), ".nar")
+	if !ok || strings.Contains(hashPart, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	var started bool
+
+	err := cache.NarWithContext(r.Context(), Conn, hashPart, w, func(resp cache.NarResponse) {
+		started = true
+		w.Header().Set("Content-Type", "application/x-nix-nar")
+		w.Header().Set("Content-Length", strconv.FormatUint(resp.NarSize, 10))
+		w.WriteHeader(http.StatusOK)
+	})
+
+	if err == nil {
+		return
+	} else if !started {
+		writeError(w, r, err)
+		return
+	}
+
+	// the response is already underway, so the best we can do is abort the connection
+	logger.Error("failed to stream nar", "hash", hashPart, "error", err)
+	panic(http.ErrAbortHandler)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var reqErr *nnats.RequestError
+	if errors.As(err, &reqErr) && reqErr.Code == "404" {
+		http.NotFound(w, r)
+		return
+	}
+
+	logger.Error("cache request failed", "path", r.URL.Path, "error", err)
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
@@ -12,6 +12,8 @@ const (
 	ConnKey   = "conn"
 	NKeyKey   = "nkey"
 	ClaimsKey = "claims"
+
+	StateDirectoryKey = "state-directory"
 )
 
 func SetClaims(ctx context.Context, claims *jwt.UserClaims) context.Context {
@@ -37,3 +39,11 @@ func SetNKey(ctx context.Context, nkey string) context.Context {
 func GetNKey(ctx context.Context) string {
 	return ctx.Value(NKeyKey).(string)
 }
+
+func SetStateDirectory(ctx context.Context, dir string) context.Context {
+	return context.WithValue(ctx, StateDirectoryKey, dir)
+}
+
+func GetStateDirectory(ctx context.Context) string {
+	return ctx.Value(StateDirectoryKey).(string)
+}
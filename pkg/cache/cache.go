@@ -0,0 +1,209 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/juju/errors"
+	mh "github.com/multiformats/go-multihash/core"
+	"github.com/nats-io/nats.go"
+	"github.com/nix-community/go-nix/pkg/hash"
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/nix-community/go-nix/pkg/narinfo"
+	"github.com/nix-community/go-nix/pkg/narinfo/signature"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"github.com/nix-community/go-nix/pkg/storepath"
+	"github.com/numtide/nits/pkg/nix"
+)
+
+// Bucket is the name of the object store which holds the NARs and narinfos of closures transferred to agents.
+const Bucket = "nits-cache"
+
+// NarInfoName returns the name of the object holding the narinfo for a store path.
+func NarInfoName(path *storepath.StorePath) string {
+	return nixbase32.EncodeToString(path.Digest) + ".narinfo"
+}
+
+// NarName returns the name of the object holding the NAR for a store path.
+func NarName(path *storepath.StorePath) string {
+	return "nar/" + nixbase32.EncodeToString(path.Digest) + ".nar"
+}
+
+// Upload exports the closures of the given store paths as NARs, uploading any which are missing from the object
+// store along with their narinfo. It returns the number of store paths which were uploaded.
+func Upload(ctx context.Context, obs nats.ObjectStore, paths ...string) (uploaded int, err error) {
+	var infos []nix.PathInfo
+	if infos, err = nix.QueryPathInfo(true, paths...); err != nil {
+		return 0, errors.Annotate(err, "failed to query path info")
+	}
+
+	for _, info := range infos {
+		var path *storepath.StorePath
+		if path, err = storepath.FromAbsolutePath(info.Path); err != nil {
+			return
+		}
+
+		if _, err = obs.GetInfo(NarInfoName(path), nats.Context(ctx)); err == nil {
+			log.Debug("path already uploaded", "path", info.Path)
+			continue
+		} else if !errors.Is(err, nats.ErrObjectNotFound) {
+			return
+		}
+
+		log.Info("uploading path", "path", info.Path, "size", info.NarSize)
+		if err = upload(ctx, obs, path, info); err != nil {
+			return uploaded, errors.Annotatef(err, "failed to upload %s", info.Path)
+		}
+		uploaded++
+	}
+
+	return uploaded, nil
+}
+
+func upload(ctx context.Context, obs nats.ObjectStore, path *storepath.StorePath, info nix.PathInfo) (err error) {
+	var narHash *hash.Hash
+	if narHash, err = hash.New(mh.SHA2_256); err != nil {
+		return
+	}
+
+	// stream the NAR into the object store, hashing it as we go
+	reader, writer := io.Pipe()
+	go func() {
+		_ = writer.CloseWithError(nar.DumpPath(io.MultiWriter(writer, narHash), path.Absolute()))
+	}()
+
+	if _, err = obs.Put(&nats.ObjectMeta{Name: NarName(path)}, reader, nats.Context(ctx)); err != nil {
+		_ = reader.CloseWithError(err)
+		return
+	}
+
+	var ni *narinfo.NarInfo
+	if ni, err = narInfo(path, info, narHash, narHash.BytesWritten()); err != nil {
+		return
+	}
+
+	// the narinfo is written last so that its presence implies the NAR is available
+	_, err = obs.PutBytes(NarInfoName(path), []byte(ni.String()), nats.Context(ctx))
+	return
+}
+
+// Fetch downloads the narinfo and NAR of every path within the closure which is not valid in the local store, writing
+// them into dir using the layout of a file:// binary cache. It returns the store paths which were fetched. If any keys
+// are given, each narinfo must be signed by one of them. Nix checks each NAR against the hash in its narinfo when it
+// is imported.
+func Fetch(
+	ctx context.Context, obs nats.ObjectStore, closure *storepath.StorePath, dir string, keys []signature.PublicKey,
+) (fetched []string, err error) {
+	if err = os.MkdirAll(filepath.Join(dir, "nar"), 0o755); err != nil {
+		return
+	}
+
+	cacheInfo := fmt.Sprintf("StoreDir: %s\n", storepath.StoreDir)
+	if err = os.WriteFile(filepath.Join(dir, "nix-cache-info"), []byte(cacheInfo), 0o644); err != nil {
+		return
+	}
+
+	seen := map[string]bool{closure.Absolute(): true}
+	frontier := []string{closure.Absolute()}
+
+	// the closure of a valid path is always valid, so we only need to descend into the references of invalid paths
+	for len(frontier) > 0 {
+		var invalid []string
+		if invalid, err = nix.InvalidPaths(frontier...); err != nil {
+			return fetched, errors.Annotate(err, "failed to check path validity")
+		}
+
+		frontier = nil
+
+		for _, absolute := range invalid {
+			var (
+				path *storepath.StorePath
+				ni   *narinfo.NarInfo
+			)
+
+			if path, err = storepath.FromAbsolutePath(absolute); err != nil {
+				return
+			} else if ni, err = fetch(ctx, obs, path, dir, keys); err != nil {
+				return fetched, errors.Annotatef(err, "failed to fetch %s", absolute)
+			}
+
+			fetched = append(fetched, absolute)
+
+			for _, ref := range ni.References {
+				ref = storepath.StoreDir + "/" + ref
+				if !seen[ref] {
+					seen[ref] = true
+					frontier = append(frontier, ref)
+				}
+			}
+		}
+	}
+
+	return
+}
+
+func fetch(
+	ctx context.Context, obs nats.ObjectStore, path *storepath.StorePath, dir string, keys []signature.PublicKey,
+) (ni *narinfo.NarInfo, err error) {
+	var data []byte
+	if data, err = obs.GetBytes(NarInfoName(path), nats.Context(ctx)); err != nil {
+		return
+	} else if ni, err = narinfo.Parse(bytes.NewReader(data)); err != nil {
+		return
+	} else if ni.StorePath != path.Absolute() {
+		return nil, errors.Errorf("narinfo is for another path: %s", ni.StorePath)
+	} else if len(keys) > 0 && !isSigned(ni, keys) {
+		return nil, ErrUntrustedPaths
+	} else if err = os.WriteFile(filepath.Join(dir, NarInfoName(path)), data, 0o644); err != nil {
+		return
+	}
+
+	err = obs.GetFile(ni.URL, filepath.Join(dir, ni.URL), nats.Context(ctx))
+	return
+}
+
+// narInfo creates an uncompressed narinfo for a store path.
+func narInfo(path *storepath.StorePath, info nix.PathInfo, narHash *hash.Hash, narSize uint64) (ni *narinfo.NarInfo, err error) {
+	ni = &narinfo.NarInfo{
+		StorePath:   path.Absolute(),
+		URL:         NarName(path),
+		Compression: "none",
+		NarHash:     narHash,
+		NarSize:     narSize,
+		Deriver:     strings.TrimPrefix(info.Deriver, storepath.StoreDir+"/"),
+	}
+
+	for _, ref := range info.References {
+		ni.References = append(ni.References, strings.TrimPrefix(ref, storepath.StoreDir+"/"))
+	}
+
+	for _, sig := range info.Signatures {
+		var parsed signature.Signature
+		if parsed, err = signature.ParseSignature(sig); err != nil {
+			return nil, errors.Annotatef(err, "malformed signature: %s", sig)
+		}
+		ni.Signatures = append(ni.Signatures, parsed)
+	}
+
+	return
+}
+
+// parseNarHash parses a NAR hash as reported by nix path-info, which depending on the version of nix is either in
+// the form sha256:<nixbase32> or an SRI hash.
+func parseNarHash(str string) (*hash.Hash, error) {
+	if encoded, ok := strings.CutPrefix(str, "sha256-"); ok {
+		digest, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.Annotatef(err, "malformed nar hash: %s", str)
+		}
+		return hash.FromHashTypeAndDigest(mh.SHA2_256, digest)
+	}
+	return hash.ParseNixBase32(str)
+}
@@ -0,0 +1,312 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/nix-community/go-nix/pkg/hash"
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/nix-community/go-nix/pkg/narinfo"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"github.com/nix-community/go-nix/pkg/storepath"
+	nnats "github.com/numtide/nits/pkg/nats"
+	"github.com/numtide/nits/pkg/nix"
+	"github.com/numtide/nits/pkg/subject"
+)
+
+const (
+	// ChunkSize is the maximum size of each message when streaming a NAR.
+	ChunkSize = 128 * 1024
+	// ChunkTimeout is how long to wait for the next chunk of a NAR before giving up. The server gives up on a NAR once it
+	// has not been asked for a chunk for this long.
+	ChunkTimeout = 30 * time.Second
+	// ChunkWindow is how many chunks of a NAR a client asks for ahead of those it has received.
+	ChunkWindow = 8
+
+	ErrPathNotFound = errors.ConstError("path not found")
+)
+
+type NarInfoRequest struct {
+	// the hash part of the store path
+	Hash string `json:"hash"`
+}
+
+type NarInfoResponse struct {
+	NarInfo string `json:"nar-info"`
+}
+
+type NarRequest struct {
+	// the hash part of the store path
+	Hash string `json:"hash"`
+}
+
+type NarResponse struct {
+	NarSize uint64 `json:"nar-size"`
+	// the subject from which the NAR is pulled, each message published to it with a reply subject is answered with
+	// the next chunk of the NAR, until an end of stream
+	Stream string `json:"stream"`
+}
+
+// Serve adds a service which answers binary cache requests from the local nix store.
+func Serve(conn *nats.Conn) (srv micro.Service, err error) {
+	if srv, err = micro.AddService(conn, micro.Config{
+		Name:        "NitsCache",
+		Version:     "0.0.1",
+		Description: "A binary cache for the local nix store.",
+	}); err != nil {
+		return
+	}
+
+	group := srv.AddGroup(subject.CacheServicePrefix())
+
+	if err = group.AddEndpoint("NARINFO", micro.HandlerFunc(onNarInfo)); err != nil {
+		return
+	} else if err = group.AddEndpoint("NAR", micro.HandlerFunc(func(req micro.Request) {
+		onNar(conn, req)
+	})); err != nil {
+		return
+	}
+
+	return
+}
+
+func onNarInfo(req micro.Request) {
+	var (
+		err     error
+		request NarInfoRequest
+		path    *storepath.StorePath
+		info    nix.PathInfo
+		narHash *hash.Hash
+		ni      *narinfo.NarInfo
+	)
+
+	if err = json.Unmarshal(req.Data(), &request); err != nil {
+		_ = req.Error("400", fmt.Sprintf("Failed to unmarshal request: %s", err), nil)
+		return
+	}
+
+	if path, info, err = queryPath(request.Hash); errors.Is(err, ErrPathNotFound) {
+		_ = req.Error("404", "Path not found.", nil)
+		return
+	} else if err != nil {
+		_ = req.Error("400", err.Error(), nil)
+		return
+	}
+
+	if narHash, err = parseNarHash(info.NarHash); err != nil {
+		_ = req.Error("500", err.Error(), nil)
+		return
+	} else if ni, err = narInfo(path, info, narHash, info.NarSize); err != nil {
+		_ = req.Error("500", err.Error(), nil)
+		return
+	}
+
+	if err = req.RespondJSON(NarInfoResponse{NarInfo: ni.String()}); err != nil {
+		log.Error("failed to respond", "error", err)
+	}
+}
+
+func onNar(conn *nats.Conn, req micro.Request) {
+	var (
+		err     error
+		request NarRequest
+		path    *storepath.StorePath
+		info    nix.PathInfo
+	)
+
+	if err = json.Unmarshal(req.Data(), &request); err != nil {
+		_ = req.Error("400", fmt.Sprintf("Failed to unmarshal request: %s", err), nil)
+		return
+	}
+
+	if path, info, err = queryPath(request.Hash); errors.Is(err, ErrPathNotFound) {
+		_ = req.Error("404", "Path not found.", nil)
+		return
+	} else if err != nil {
+		_ = req.Error("400", err.Error(), nil)
+		return
+	}
+
+	var stream string
+	if stream, err = serveNar(conn, path); err != nil {
+		_ = req.Error("500", err.Error(), nil)
+		return
+	}
+
+	if err = req.RespondJSON(NarResponse{NarSize: info.NarSize, Stream: stream}); err != nil {
+		log.Error("failed to respond", "error", err)
+	}
+}
+
+// serveNar dumps the NAR of a store path in the background and returns a subject from which it can be pulled a chunk
+// at a time. The dump only proceeds as fast as chunks are asked for, and is abandoned if they stop being asked for.
+func serveNar(conn *nats.Conn, path *storepath.StorePath) (stream string, err error) {
+	reader, writer := io.Pipe()
+	stream = conn.NewInbox()
+
+	var (
+		sub  *nats.Subscription
+		idle *time.Timer
+		buf  = make([]byte, ChunkSize)
+	)
+
+	stop := func(err error) {
+		idle.Stop()
+		if sub != nil {
+			_ = sub.Unsubscribe()
+		}
+		// unblocks the dump if it is still in progress
+		_ = reader.CloseWithError(err)
+	}
+
+	idle = time.AfterFunc(ChunkTimeout, func() {
+		log.Warn("abandoning nar, no chunks have been requested", "path", path.Absolute())
+		stop(errors.New("nar was abandoned"))
+	})
+
+	// chunks are only ever sent to whoever asked for them, and are read one at a time as messages for a subscription
+	// are handled in order
+	if sub, err = conn.Subscribe(stream, func(msg *nats.Msg) {
+		if msg.Reply == "" {
+			return
+		}
+		idle.Reset(ChunkTimeout)
+
+		n, err := io.ReadFull(reader, buf)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// the final chunk
+			err = nil
+		}
+
+		resp := nats.NewMsg(msg.Reply)
+		switch {
+		case err == io.EOF:
+			resp.Header.Set(nnats.EOS, nnats.EOSValue)
+			stop(err)
+		case err != nil:
+			log.Error("failed to dump path", "path", path.Absolute(), "error", err)
+			resp.Header.Set(micro.ErrorCodeHeader, "500")
+			resp.Header.Set(micro.ErrorHeader, err.Error())
+			stop(err)
+		default:
+			resp.Data = buf[:n]
+		}
+
+		if err = conn.PublishMsg(resp); err != nil {
+			log.Error("failed to send nar chunk", "path", path.Absolute(), "error", err)
+			stop(err)
+		}
+	}); err != nil {
+		stop(err)
+		return "", err
+	}
+
+	go func() {
+		_ = writer.CloseWithError(nar.DumpPath(writer, path.Absolute()))
+	}()
+
+	return stream, nil
+}
+
+// queryPath finds the store path with the given hash part and returns its info.
+func queryPath(hashPart string) (path *storepath.StorePath, info nix.PathInfo, err error) {
+	if len(hashPart) != nixbase32.EncodedLen(storepath.PathHashSize) {
+		return nil, info, errors.Errorf("malformed hash: %s", hashPart)
+	} else if err = nixbase32.ValidateString(hashPart); err != nil {
+		return nil, info, errors.Annotatef(err, "malformed hash: %s", hashPart)
+	}
+
+	var matches []string
+	if matches, err = filepath.Glob(filepath.Join(storepath.StoreDir, hashPart+"-*")); err != nil {
+		return
+	}
+
+	for _, match := range matches {
+		if strings.HasSuffix(match, ".lock") {
+			continue
+		}
+
+		var infos []nix.PathInfo
+		if infos, err = nix.QueryPathInfo(false, match); err != nil || len(infos) != 1 {
+			// the path is not valid
+			continue
+		}
+
+		path, err = storepath.FromAbsolutePath(match)
+		return path, infos[0], err
+	}
+
+	return nil, info, ErrPathNotFound
+}
+
+// NarInfoWithContext requests the narinfo for the store path with the given hash part.
+func NarInfoWithContext(ctx context.Context, conn *nats.EncodedConn, hashPart string) (resp NarInfoResponse, err error) {
+	err = nnats.RequestWithContext(ctx, conn, subject.CacheService("NARINFO"), NarInfoRequest{Hash: hashPart}, &resp)
+	return
+}
+
+// NarWithContext requests the NAR for the store path with the given hash part and writes it to w as it is received.
+// The callback is invoked once the request has been accepted and before any of the NAR is written.
+func NarWithContext(
+	ctx context.Context,
+	conn *nats.EncodedConn,
+	hashPart string,
+	w io.Writer,
+	accepted func(resp NarResponse),
+) (err error) {
+	var resp NarResponse
+	if err = nnats.RequestWithContext(ctx, conn, subject.CacheService("NAR"), NarRequest{Hash: hashPart}, &resp); err != nil {
+		return
+	}
+
+	accepted(resp)
+
+	inbox := conn.Conn.NewInbox()
+
+	var sub *nats.Subscription
+	if sub, err = conn.Conn.SubscribeSync(inbox); err != nil {
+		return
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	// ask for the next chunk, keeping a window of chunks in flight so that we are not waiting on each round trip
+	pull := func() error {
+		return conn.Conn.PublishRequest(resp.Stream, inbox, nil)
+	}
+
+	for i := 0; i < ChunkWindow; i++ {
+		if err = pull(); err != nil {
+			return
+		}
+	}
+
+	var msg *nats.Msg
+	for {
+		chunkCtx, cancel := context.WithTimeout(ctx, ChunkTimeout)
+		msg, err = sub.NextMsgWithContext(chunkCtx)
+		cancel()
+
+		if err != nil {
+			return errors.Annotate(err, "failed to receive nar")
+		} else if err = nnats.ResponseError(msg); err != nil {
+			return errors.Annotate(err, "failed to receive nar")
+		} else if eos, _ := nnats.IsEndOfStream(msg); eos {
+			return nil
+		} else if _, err = w.Write(msg.Data); err != nil {
+			return
+		} else if err = pull(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	nnats "github.com/numtide/nits/pkg/nats"
+	"github.com/numtide/nits/pkg/subject"
+)
+
+func runServer(t *testing.T) *nats.Conn {
+	t.Helper()
+
+	srv, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Start()
+	t.Cleanup(srv.Shutdown)
+
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server did not start")
+	}
+
+	conn, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+
+	return conn
+}
+
+func TestServe(t *testing.T) {
+	conn := runServer(t)
+
+	srv, err := Serve(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = srv.Stop()
+	})
+
+	subjects := make(map[string]bool)
+	for _, endpoint := range srv.Info().Endpoints {
+		subjects[endpoint.Subject] = true
+	}
+
+	for _, name := range []string{"NARINFO", "NAR"} {
+		t.Run(name, func(t *testing.T) {
+			subj := subject.CacheService(name)
+			if !subjects[subj] {
+				t.Fatalf("expected an endpoint on %s, got %v", subj, subjects)
+			}
+
+			// a malformed request is rejected by the handler without touching the nix store
+			msg, err := conn.Request(subj, []byte("not json"), 5*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var reqErr *nnats.RequestError
+			if reqErr, _ = nnats.ResponseError(msg).(*nnats.RequestError); reqErr == nil {
+				t.Fatalf("expected an error response, got %q", msg.Data)
+			} else if reqErr.Code != "400" {
+				t.Fatalf("expected a 400 response, got %s: %s", reqErr.Code, reqErr.Description)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/nix-community/go-nix/pkg/hash"
+	"github.com/nix-community/go-nix/pkg/narinfo"
+	"github.com/nix-community/go-nix/pkg/narinfo/signature"
+	"github.com/nix-community/go-nix/pkg/storepath"
+	"github.com/numtide/nits/pkg/nix"
+)
+
+const ErrUntrustedPaths = errors.ConstError("paths are not signed by a trusted key")
+
+// ParsePublicKeys parses keys in the form <name>:<base64 key> as used by nix's trusted-public-keys setting.
+func ParsePublicKeys(strs []string) (keys []signature.PublicKey, err error) {
+	for _, str := range strs {
+		var key signature.PublicKey
+		if key, err = signature.ParsePublicKey(str); err != nil {
+			return nil, errors.Annotatef(err, "malformed public key: %s", str)
+		}
+		keys = append(keys, key)
+	}
+	return
+}
+
+// VerifySignatures checks that each of the given paths carries a valid signature from at least one of the keys.
+func VerifySignatures(infos []nix.PathInfo, keys []signature.PublicKey) error {
+	var untrusted []string
+
+	for _, info := range infos {
+		trusted, err := isTrusted(info, keys)
+		if err != nil {
+			return errors.Annotatef(err, "failed to verify %s", info.Path)
+		} else if !trusted {
+			untrusted = append(untrusted, info.Path)
+		}
+	}
+
+	if len(untrusted) == 0 {
+		return nil
+	}
+
+	// a closure can contain thousands of paths, a few is enough to diagnose the problem
+	examples := untrusted[:min(len(untrusted), 3)]
+	return fmt.Errorf("%w: %d path(s) including %s", ErrUntrustedPaths, len(untrusted), strings.Join(examples, ", "))
+}
+
+func isTrusted(info nix.PathInfo, keys []signature.PublicKey) (bool, error) {
+	var (
+		err     error
+		path    *storepath.StorePath
+		narHash *hash.Hash
+		ni      *narinfo.NarInfo
+	)
+
+	if path, err = storepath.FromAbsolutePath(info.Path); err != nil {
+		return false, err
+	} else if narHash, err = parseNarHash(info.NarHash); err != nil {
+		return false, err
+	} else if ni, err = narInfo(path, info, narHash, info.NarSize); err != nil {
+		return false, err
+	}
+
+	return isSigned(ni, keys), nil
+}
+
+// isSigned returns true if the narinfo carries a valid signature from at least one of the keys.
+func isSigned(ni *narinfo.NarInfo, keys []signature.PublicKey) bool {
+	fingerprint := ni.Fingerprint()
+
+	for _, key := range keys {
+		for _, sig := range ni.Signatures {
+			if key.Verify(fingerprint, sig) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/narinfo/signature"
+	"github.com/nix-community/go-nix/pkg/storepath"
+	"github.com/numtide/nits/pkg/nix"
+)
+
+const (
+	trustedSecretKey = "nits-test-1:AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQGKiOPddAnxlf1S2y08ul1yymcJvx2UEhvzdIgBtA9vXA=="
+	trustedPublicKey = "nits-test-1:iojj3XQJ8ZX9UtstPLpdcspnCb8dlBIb83SIAbQPb1w="
+	otherSecretKey   = "nits-other-1:AgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgKBOXcOqH0XX1ajVGbDTH7My42KkbTuN6Jd9g9bj8mzlA=="
+	otherPublicKey   = "nits-other-1:gTl3Dqh9F19Wo1Rmw0x+zMuNipG07jeiXfYPW4/Js5Q="
+
+	// the same digest in both of the forms which nix path-info reports, depending on its version
+	narHashBase32 = "sha256:0gsyc3g0w8wacg97wwm1iirigsl96k36iijdxiadn8cqcjmx18y1"
+	narHashSRI    = "sha256-waPQq2SYIdtU7E3GaMY0ieoXc4yhcn7SY4ojDt5gXj8="
+	otherNarHash  = "sha256:18nqj39qp2nhwfns6g3fc80qxd7w462llq6g6qhqn46pdkn873qr"
+
+	storePath     = "/nix/store/00bgd045z0d4icpbc2yyz4gx48ak44la-hello-2.12.1"
+	referencePath = "/nix/store/7rjsqb6gd6l8l0a3p3cr6g1d9dpv7jlk-glibc-2.38"
+)
+
+func pathInfo(narHash string) nix.PathInfo {
+	return nix.PathInfo{
+		Path:       storePath,
+		NarHash:    narHash,
+		NarSize:    226552,
+		References: []string{referencePath, storePath},
+	}
+}
+
+// sign adds a signature by the given secret key over the narinfo fingerprint of info.
+func sign(t *testing.T, info nix.PathInfo, secretKey string) nix.PathInfo {
+	t.Helper()
+
+	key, err := signature.LoadSecretKey(secretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := storepath.FromAbsolutePath(info.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	narHash, err := parseNarHash(info.NarHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ni, err := narInfo(path, info, narHash, info.NarSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig, err := key.Sign(nil, ni.Fingerprint())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info.Signatures = append(info.Signatures, sig.String())
+	return info
+}
+
+func TestParseNarHash(t *testing.T) {
+	base32, err := parseNarHash(narHashBase32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sri, err := parseNarHash(narHashSRI)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if base32.NixString() != narHashBase32 {
+		t.Errorf("expected %s, got %s", narHashBase32, base32.NixString())
+	}
+	if sri.NixString() != narHashBase32 {
+		t.Errorf("expected %s, got %s", narHashBase32, sri.NixString())
+	}
+
+	for _, str := range []string{"", "sha256-not base64", "sha256:tooshort", "md5:0gsyc3g0w8wacg97wwm1iirigsl96k36"} {
+		if _, err = parseNarHash(str); err == nil {
+			t.Errorf("expected an error for %q", str)
+		}
+	}
+}
+
+func TestIsTrusted(t *testing.T) {
+	keys, err := ParsePublicKeys([]string{trustedPublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := sign(t, pathInfo(narHashBase32), trustedSecretKey)
+	tampered.NarHash = otherNarHash
+
+	extraReference := sign(t, pathInfo(narHashBase32), trustedSecretKey)
+	extraReference.References = append(extraReference.References, "/nix/store/0jzxlrmx9kdplz7gxnbx1zrd8mg8lwib-evil")
+
+	sri := sign(t, pathInfo(narHashBase32), trustedSecretKey)
+	sri.NarHash = narHashSRI
+
+	tests := []struct {
+		name     string
+		info     nix.PathInfo
+		expected bool
+		err      bool
+	}{
+		{name: "signed", info: sign(t, pathInfo(narHashBase32), trustedSecretKey), expected: true},
+		{name: "signed with an sri hash", info: sign(t, pathInfo(narHashSRI), trustedSecretKey), expected: true},
+		{name: "signed over base32 and reported as sri", info: sri, expected: true},
+		{name: "unsigned", info: pathInfo(narHashBase32), expected: false},
+		{name: "signed by another key", info: sign(t, pathInfo(narHashBase32), otherSecretKey), expected: false},
+		{
+			name:     "signed by another key and the trusted key",
+			info:     sign(t, sign(t, pathInfo(narHashBase32), otherSecretKey), trustedSecretKey),
+			expected: true,
+		},
+		{name: "tampered hash", info: tampered, expected: false},
+		{name: "tampered references", info: extraReference, expected: false},
+		{
+			name: "malformed signature",
+			info: nix.PathInfo{Path: storePath, NarHash: narHashBase32, Signatures: []string{"nits-test-1:bogus"}},
+			err:  true,
+		},
+		{name: "malformed hash", info: pathInfo("sha256:bogus"), err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted, err := isTrusted(tt.info, keys)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			} else if trusted != tt.expected {
+				t.Fatalf("expected %v, got %v", tt.expected, trusted)
+			}
+		})
+	}
+}
+
+func TestVerifySignatures(t *testing.T) {
+	keys, err := ParsePublicKeys([]string{otherPublicKey, trustedPublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := sign(t, pathInfo(narHashBase32), trustedSecretKey)
+	alsoSigned := sign(t, pathInfo(narHashSRI), otherSecretKey)
+	unsigned := pathInfo(narHashBase32)
+
+	if err = VerifySignatures([]nix.PathInfo{signed, alsoSigned}, keys); err != nil {
+		t.Fatalf("expected paths signed by either key to be trusted: %v", err)
+	}
+
+	if err = VerifySignatures([]nix.PathInfo{signed, unsigned}, keys); !errors.Is(err, ErrUntrustedPaths) {
+		t.Fatalf("expected ErrUntrustedPaths, got %v", err)
+	}
+
+	if err = VerifySignatures([]nix.PathInfo{signed}, nil); !errors.Is(err, ErrUntrustedPaths) {
+		t.Fatalf("expected no keys to trust nothing, got %v", err)
+	}
+
+	if _, err = ParsePublicKeys([]string{"nits-test-1:bogus"}); err == nil {
+		t.Fatal("expected an error for a malformed public key")
+	}
+}
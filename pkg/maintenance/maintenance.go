@@ -0,0 +1,230 @@
+package maintenance
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	// ensure time zones can be resolved on hosts without a zoneinfo database
+	_ "time/tzdata"
+
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+)
+
+// Bucket is the name of the KV bucket which holds the maintenance windows for each agent, keyed by NKey.
+const Bucket = "agent-maintenance-windows"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a recurring period of time during which an agent may activate a new system.
+type Window struct {
+	spec string
+
+	days     [7]bool
+	start    time.Duration
+	end      time.Duration
+	location *time.Location
+}
+
+// Parse parses a window in the form "<days> <start>-<end> [<time zone>]" e.g. "Sun 02:00-04:00 Europe/Oslo".
+// Days are given as a comma separated list of names or ranges such as "Mon-Fri,Sun", or "*" for every day. A window
+// which ends before it starts crosses midnight. The time zone defaults to UTC.
+func Parse(spec string) (w Window, err error) {
+	fields := strings.Fields(spec)
+	if len(fields) < 2 || len(fields) > 3 {
+		return w, errors.Errorf("malformed maintenance window: %s", spec)
+	}
+
+	w.spec = strings.Join(fields, " ")
+
+	if err = w.parseDays(fields[0]); err != nil {
+		return
+	}
+
+	start, end, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return w, errors.Errorf("malformed time range in maintenance window: %s", fields[1])
+	} else if w.start, err = parseTimeOfDay(start); err != nil {
+		return
+	} else if w.end, err = parseTimeOfDay(end); err != nil {
+		return
+	} else if w.start == w.end {
+		return w, errors.Errorf("maintenance window cannot be empty: %s", spec)
+	}
+
+	w.location = time.UTC
+	if len(fields) == 3 {
+		if w.location, err = time.LoadLocation(fields[2]); err != nil {
+			return w, errors.Annotatef(err, "unknown time zone in maintenance window: %s", fields[2])
+		}
+	}
+
+	return
+}
+
+func (w *Window) parseDays(str string) error {
+	if str == "*" {
+		for idx := range w.days {
+			w.days[idx] = true
+		}
+		return nil
+	}
+
+	for _, term := range strings.Split(strings.ToLower(str), ",") {
+		from, to, isRange := strings.Cut(term, "-")
+		if !isRange {
+			to = from
+		}
+
+		first, ok := weekdays[from]
+		if !ok {
+			return errors.Errorf("unknown day in maintenance window: %s", from)
+		}
+		last, ok := weekdays[to]
+		if !ok {
+			return errors.Errorf("unknown day in maintenance window: %s", to)
+		}
+
+		// ranges may wrap around the end of the week e.g. Sat-Mon
+		for day := first; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseTimeOfDay(str string) (time.Duration, error) {
+	t, err := time.Parse("15:04", str)
+	if err != nil {
+		return 0, errors.Errorf("malformed time in maintenance window: %s", str)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w Window) String() string {
+	return w.spec
+}
+
+func (w Window) MarshalText() ([]byte, error) {
+	return []byte(w.spec), nil
+}
+
+func (w *Window) UnmarshalText(text []byte) (err error) {
+	*w, err = Parse(string(text))
+	return
+}
+
+// Next returns the start and end of the first occurrence of the window which ends after now. If now is within the
+// window, start will be before now.
+func (w Window) Next(now time.Time) (start time.Time, end time.Time) {
+	local := now.In(w.location)
+
+	// begin with yesterday in case we are within a window which crossed midnight
+	for offset := -1; offset <= 7; offset++ {
+		day := time.Date(local.Year(), local.Month(), local.Day()+offset, 0, 0, 0, 0, w.location)
+		if !w.days[day.Weekday()] {
+			continue
+		}
+
+		start = w.at(day, w.start)
+		if w.end < w.start {
+			end = w.at(day.AddDate(0, 0, 1), w.end)
+		} else {
+			end = w.at(day, w.end)
+		}
+
+		// a short window can vanish when the clocks go forward
+		if end.After(start) && end.After(now) {
+			return
+		}
+	}
+
+	// unreachable for a valid window, as every window occurs at least once a week
+	panic(fmt.Sprintf("failed to find next occurrence of maintenance window: %s", w.spec))
+}
+
+// at returns the given time of day on the given day. The instant is built from the wall clock rather than by adding to
+// midnight, so that windows keep their local times on days when daylight saving time begins or ends.
+func (w Window) at(day time.Time, timeOfDay time.Duration) time.Time {
+	hour := int(timeOfDay / time.Hour)
+	minute := int(timeOfDay % time.Hour / time.Minute)
+	return time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, w.location)
+}
+
+// Windows is the set of maintenance windows for an agent. An empty set places no restrictions on activation.
+type Windows []Window
+
+// ParseAll parses each of the given window specs.
+func ParseAll(specs []string) (windows Windows, err error) {
+	for _, spec := range specs {
+		var w Window
+		if w, err = Parse(spec); err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return
+}
+
+// Next returns the start and end of the earliest window which ends after now. It returns false if there are no windows.
+func (ws Windows) Next(now time.Time) (start time.Time, end time.Time, ok bool) {
+	for _, w := range ws {
+		s, e := w.Next(now)
+		if !ok || s.Before(start) {
+			start, end, ok = s, e, true
+		}
+	}
+	return
+}
+
+func (ws Windows) String() string {
+	specs := make([]string, len(ws))
+	for idx, w := range ws {
+		specs[idx] = w.String()
+	}
+	return strings.Join(specs, ", ")
+}
+
+// Open returns true if now is within a window, or if there are no windows.
+func (ws Windows) Open(now time.Time) bool {
+	start, _, ok := ws.Next(now)
+	return !ok || !start.After(now)
+}
+
+// Set records the maintenance windows for the agent with the given nkey.
+func Set(js nats.JetStreamContext, nkey string, windows Windows) (revision uint64, err error) {
+	var (
+		kv   nats.KeyValue
+		data []byte
+	)
+
+	if kv, err = js.KeyValue(Bucket); err != nil {
+		return
+	} else if data, err = json.Marshal(windows); err != nil {
+		return
+	}
+
+	return kv.Put(nkey, data)
+}
+
+// Clear removes the maintenance windows for the agent with the given nkey, allowing it to activate at any time.
+func Clear(js nats.JetStreamContext, nkey string) (err error) {
+	var kv nats.KeyValue
+	if kv, err = js.KeyValue(Bucket); err != nil {
+		return
+	}
+	return kv.Delete(nkey)
+}
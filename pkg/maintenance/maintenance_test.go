@@ -0,0 +1,279 @@
+package maintenance
+
+import (
+	"testing"
+	"time"
+)
+
+func mustParse(t *testing.T, spec string) Window {
+	t.Helper()
+	w, err := Parse(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func utc(str string) time.Time {
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		panic(err)
+	}
+	return t.UTC()
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec string
+		days []time.Weekday
+		err  bool
+	}{
+		{spec: "Sun 02:00-04:00", days: []time.Weekday{time.Sunday}},
+		{spec: "sun 02:00-04:00 Europe/Oslo", days: []time.Weekday{time.Sunday}},
+		{spec: "* 22:00-02:00", days: []time.Weekday{0, 1, 2, 3, 4, 5, 6}},
+		{spec: "Mon-Fri 01:00-02:00", days: []time.Weekday{1, 2, 3, 4, 5}},
+		{spec: "Sat-Mon 01:00-02:00", days: []time.Weekday{time.Sunday, time.Monday, time.Saturday}},
+		{spec: "Mon,Wed,Fri 01:00-02:00", days: []time.Weekday{time.Monday, time.Wednesday, time.Friday}},
+		{spec: "  Sun   02:00-04:00  ", days: []time.Weekday{time.Sunday}},
+		{spec: "", err: true},
+		{spec: "Sun", err: true},
+		{spec: "Sun 02:00-04:00 Europe/Oslo extra", err: true},
+		{spec: "Funday 02:00-04:00", err: true},
+		{spec: "Mon-Funday 02:00-04:00", err: true},
+		{spec: "Sun 02:00", err: true},
+		{spec: "Sun 2am-4am", err: true},
+		{spec: "Sun 25:00-04:00", err: true},
+		{spec: "Sun 02:00-02:00", err: true},
+		{spec: "Sun 02:00-04:00 Mars/Olympus", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			w, err := Parse(tt.spec)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", w)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			var expected [7]bool
+			for _, day := range tt.days {
+				expected[day] = true
+			}
+			if w.days != expected {
+				t.Fatalf("expected days %v, got %v", expected, w.days)
+			}
+		})
+	}
+}
+
+func TestWindowString(t *testing.T) {
+	w := mustParse(t, "  Sun   02:00-04:00  Europe/Oslo ")
+	if s := w.String(); s != "Sun 02:00-04:00 Europe/Oslo" {
+		t.Fatalf("unexpected spec: %s", s)
+	}
+
+	var unmarshalled Window
+	if err := unmarshalled.UnmarshalText([]byte(w.String())); err != nil {
+		t.Fatal(err)
+	} else if unmarshalled.String() != w.String() {
+		t.Fatalf("expected %s, got %s", w, unmarshalled)
+	}
+}
+
+func TestWindowNext(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  string
+		now   string
+		start string
+		end   string
+	}{
+		{
+			name:  "later today",
+			spec:  "* 02:00-04:00",
+			now:   "2024-06-05T01:00:00Z",
+			start: "2024-06-05T02:00:00Z",
+			end:   "2024-06-05T04:00:00Z",
+		},
+		{
+			name:  "within window",
+			spec:  "* 02:00-04:00",
+			now:   "2024-06-05T03:00:00Z",
+			start: "2024-06-05T02:00:00Z",
+			end:   "2024-06-05T04:00:00Z",
+		},
+		{
+			name:  "at the end of the window",
+			spec:  "* 02:00-04:00",
+			now:   "2024-06-05T04:00:00Z",
+			start: "2024-06-06T02:00:00Z",
+			end:   "2024-06-06T04:00:00Z",
+		},
+		{
+			name:  "next week",
+			spec:  "Sun 02:00-04:00",
+			now:   "2024-06-02T05:00:00Z", // a sunday
+			start: "2024-06-09T02:00:00Z",
+			end:   "2024-06-09T04:00:00Z",
+		},
+		{
+			name:  "crossing midnight before it starts",
+			spec:  "Sat 22:00-02:00",
+			now:   "2024-06-01T12:00:00Z", // a saturday
+			start: "2024-06-01T22:00:00Z",
+			end:   "2024-06-02T02:00:00Z",
+		},
+		{
+			name:  "crossing midnight after midnight",
+			spec:  "Sat 22:00-02:00",
+			now:   "2024-06-02T01:00:00Z", // the sunday after
+			start: "2024-06-01T22:00:00Z",
+			end:   "2024-06-02T02:00:00Z",
+		},
+		{
+			name:  "crossing midnight at the end of the week",
+			spec:  "Sat 23:00-01:00",
+			now:   "2024-06-02T02:00:00Z",
+			start: "2024-06-08T23:00:00Z",
+			end:   "2024-06-09T01:00:00Z",
+		},
+		{
+			name:  "time zone",
+			spec:  "* 02:00-04:00 Europe/Oslo",
+			now:   "2024-06-05T12:00:00Z",
+			start: "2024-06-06T00:00:00Z", // CEST is two hours ahead
+			end:   "2024-06-06T02:00:00Z",
+		},
+		{
+			name:  "time zone on another day in utc",
+			spec:  "Mon 01:00-02:00 Asia/Tokyo",
+			now:   "2024-06-02T12:00:00Z", // a sunday in utc, whose evening is monday morning in tokyo
+			start: "2024-06-02T16:00:00Z",
+			end:   "2024-06-02T17:00:00Z",
+		},
+		{
+			name:  "time zone behind utc",
+			spec:  "Mon 23:00-01:00 America/New_York",
+			now:   "2024-06-03T12:00:00Z",
+			start: "2024-06-04T03:00:00Z", // EDT is four hours behind
+			end:   "2024-06-04T05:00:00Z",
+		},
+		{
+			name:  "daylight saving time begins before the window",
+			spec:  "* 04:00-05:00 Europe/Oslo",
+			now:   "2024-03-31T00:00:00Z", // clocks go forward at 02:00 CET
+			start: "2024-03-31T02:00:00Z",
+			end:   "2024-03-31T03:00:00Z",
+		},
+		{
+			name:  "daylight saving time begins during the window",
+			spec:  "* 01:00-05:00 Europe/Oslo",
+			now:   "2024-03-30T23:00:00Z",
+			start: "2024-03-31T00:00:00Z", // 01:00 CET
+			end:   "2024-03-31T03:00:00Z", // 05:00 CEST, the window is an hour shorter
+		},
+		{
+			name:  "daylight saving time ends before the window",
+			spec:  "* 04:00-05:00 Europe/Oslo",
+			now:   "2024-10-27T00:00:00Z", // clocks go back at 03:00 CEST
+			start: "2024-10-27T03:00:00Z",
+			end:   "2024-10-27T04:00:00Z",
+		},
+		{
+			name:  "daylight saving time ends during the window",
+			spec:  "* 01:00-05:00 Europe/Oslo",
+			now:   "2024-10-26T22:00:00Z",
+			start: "2024-10-26T23:00:00Z", // 01:00 CEST
+			end:   "2024-10-27T04:00:00Z", // 05:00 CET, the window is an hour longer
+		},
+		{
+			name:  "daylight saving time begins during a window crossing midnight",
+			spec:  "Sat 23:00-05:00 Europe/Oslo",
+			now:   "2024-03-30T12:00:00Z",
+			start: "2024-03-30T22:00:00Z", // 23:00 CET
+			end:   "2024-03-31T03:00:00Z", // 05:00 CEST
+		},
+		{
+			name:  "daylight saving time begins in the united states",
+			spec:  "Sun 06:00-07:00 America/New_York",
+			now:   "2024-03-10T00:00:00Z", // clocks go forward at 02:00 EST
+			start: "2024-03-10T10:00:00Z", // 06:00 EDT
+			end:   "2024-03-10T11:00:00Z",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := mustParse(t, tt.spec)
+			start, end := w.Next(utc(tt.now))
+			if !start.Equal(utc(tt.start)) {
+				t.Errorf("expected start %s, got %s", tt.start, start.UTC())
+			}
+			if !end.Equal(utc(tt.end)) {
+				t.Errorf("expected end %s, got %s", tt.end, end.UTC())
+			}
+		})
+	}
+}
+
+func TestWindowNextSkippedTime(t *testing.T) {
+	// 02:00-02:30 does not exist in Oslo on the day the clocks go forward
+	w := mustParse(t, "* 02:00-02:30 Europe/Oslo")
+
+	for now := utc("2024-03-30T12:00:00Z"); now.Before(utc("2024-04-02T00:00:00Z")); now = now.Add(15 * time.Minute) {
+		start, end := w.Next(now)
+		if !end.After(start) {
+			t.Fatalf("empty window at %s: %s-%s", now, start, end)
+		} else if !end.After(now) {
+			t.Fatalf("window at %s has already ended: %s-%s", now, start, end)
+		}
+	}
+}
+
+func TestWindows(t *testing.T) {
+	windows, err := ParseAll([]string{"Sun 02:00-04:00", "Wed 12:00-13:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		now   string
+		start string
+		open  bool
+	}{
+		{name: "before both", now: "2024-06-02T01:00:00Z", start: "2024-06-02T02:00:00Z", open: false},
+		{name: "within the first", now: "2024-06-02T03:00:00Z", start: "2024-06-02T02:00:00Z", open: true},
+		{name: "between them", now: "2024-06-03T00:00:00Z", start: "2024-06-05T12:00:00Z", open: false},
+		{name: "within the second", now: "2024-06-05T12:30:00Z", start: "2024-06-05T12:00:00Z", open: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := utc(tt.now)
+			start, _, ok := windows.Next(now)
+			if !ok {
+				t.Fatal("expected a window")
+			} else if !start.Equal(utc(tt.start)) {
+				t.Errorf("expected start %s, got %s", tt.start, start.UTC())
+			}
+			if open := windows.Open(now); open != tt.open {
+				t.Errorf("expected open to be %v", tt.open)
+			}
+		})
+	}
+
+	if !(Windows{}).Open(utc("2024-06-02T01:00:00Z")) {
+		t.Error("expected no windows to place no restriction")
+	} else if _, _, ok := (Windows{}).Next(time.Now()); ok {
+		t.Error("expected no next window without windows")
+	}
+
+	if _, err = ParseAll([]string{"Sun 02:00-04:00", "bogus"}); err == nil {
+		t.Error("expected an error for a malformed window")
+	}
+}
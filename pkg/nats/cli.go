@@ -61,13 +61,16 @@ func (c *CliOptions) ToNatsOptions() (opts []nats.Option, nkey string, claims *j
 		// override the server url using the first entry in the service urls list
 		c.Url = profile.Operator.Service[0]
 
+		if claims, err = DecodeUserClaims(encodedJwt); err != nil {
+			return
+		}
+
 		opts = append(opts, nats.UserJWT(
 			func() (string, error) {
 				return encodedJwt, nil
 			}, func(nonce []byte) ([]byte, error) {
-				defer kp.Wipe()
-				sig, err := kp.Sign(nonce)
-				return sig, err
+				// the key pair is kept for the lifetime of the connection as requests are signed with it too
+				return kp.Sign(nonce)
 			}))
 
 		return
@@ -0,0 +1,135 @@
+package nats
+
+import (
+	"encoding/base64"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	// HeaderIssuerJwt carries the user JWT of whoever made a request.
+	HeaderIssuerJwt = "Nits-Issuer-Jwt"
+	// HeaderIssuerTime is when a request was signed, in RFC 3339 format.
+	HeaderIssuerTime = "Nits-Issuer-Time"
+	// HeaderIssuerSig is a signature over the request's subject, signing time and data, made with the user's NKey.
+	HeaderIssuerSig = "Nits-Issuer-Sig"
+
+	// how far the signing time of a request may differ from our own clock
+	maxIssuerSkew = 5 * time.Minute
+
+	ErrUnsignedRequest = errors.ConstError("request has not been signed")
+)
+
+// issuerPayload returns the bytes which are signed on behalf of a request's issuer. The subject is included so that a
+// signature cannot be replayed against a different endpoint.
+func issuerPayload(subject string, timestamp string, data []byte) []byte {
+	payload := make([]byte, 0, len(subject)+len(timestamp)+len(data)+2)
+	payload = append(payload, subject...)
+	payload = append(payload, '\n')
+	payload = append(payload, timestamp...)
+	payload = append(payload, '\n')
+	return append(payload, data...)
+}
+
+// SignRequest adds headers identifying the user of the given connection to a request message, signed with the same
+// credentials used to authenticate the connection. Connections which authenticated with a bearer JWT cannot sign,
+// in which case the message is left as is.
+func SignRequest(conn *nats.Conn, msg *nats.Msg) error {
+	opts := conn.Opts
+	if opts.UserJWT == nil || opts.SignatureCB == nil {
+		return nil
+	}
+
+	token, err := opts.UserJWT()
+	if err != nil {
+		return errors.Annotate(err, "failed to retrieve user jwt")
+	}
+
+	timestamp := time.Now().UTC().Format(time.RFC3339Nano)
+
+	sig, err := opts.SignatureCB(issuerPayload(msg.Subject, timestamp, msg.Data))
+	if err != nil {
+		return errors.Annotate(err, "failed to sign request")
+	}
+
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	msg.Header.Set(HeaderIssuerJwt, token)
+	msg.Header.Set(HeaderIssuerTime, timestamp)
+	msg.Header.Set(HeaderIssuerSig, base64.RawURLEncoding.EncodeToString(sig))
+
+	return nil
+}
+
+// VerifyRequest checks the signature added to a request by SignRequest and returns the claims of the user who made it.
+// The user's JWT must have been issued by the same key as the trusted claims, which is the account or signing key the
+// caller itself was issued with.
+func VerifyRequest(
+	subject string, header nats.Header, data []byte, trusted *jwt.UserClaims,
+) (claims *jwt.UserClaims, err error) {
+	token := header.Get(HeaderIssuerJwt)
+	if token == "" {
+		return nil, ErrUnsignedRequest
+	}
+
+	// decoding verifies that the jwt was signed by its issuer
+	if claims, err = jwt.DecodeUserClaims(token); err != nil {
+		return nil, errors.Annotate(err, "failed to decode issuer jwt")
+	}
+
+	vr := jwt.CreateValidationResults()
+	claims.Validate(vr)
+
+	if vr.IsBlocking(true) {
+		return nil, errors.Errorf("issuer jwt is not valid: %v", vr.Errors())
+	} else if trusted == nil || claims.Issuer != trusted.Issuer || claims.IssuerAccount != trusted.IssuerAccount {
+		return nil, errors.Errorf("issuer jwt was not issued by a trusted key: %s", claims.Issuer)
+	}
+
+	timestamp := header.Get(HeaderIssuerTime)
+
+	var signedAt time.Time
+	if signedAt, err = time.Parse(time.RFC3339Nano, timestamp); err != nil {
+		return nil, errors.Annotate(err, "failed to parse request signing time")
+	} else if skew := time.Since(signedAt).Abs(); skew > maxIssuerSkew {
+		return nil, errors.Errorf("request was signed too long ago: %s", signedAt)
+	}
+
+	var (
+		sig []byte
+		pk  nkeys.KeyPair
+	)
+
+	if sig, err = base64.RawURLEncoding.DecodeString(header.Get(HeaderIssuerSig)); err != nil {
+		return nil, errors.Annotate(err, "failed to decode request signature")
+	} else if pk, err = nkeys.FromPublicKey(claims.Subject); err != nil {
+		return nil, errors.Annotate(err, "failed to parse issuer nkey")
+	} else if err = pk.Verify(issuerPayload(subject, timestamp, data), sig); err != nil {
+		return nil, errors.Annotate(err, "request signature is not valid")
+	}
+
+	return claims, nil
+}
+
+// IssuerName returns the name by which a verified issuer is recorded.
+func IssuerName(claims *jwt.UserClaims) string {
+	if claims.Name != "" {
+		return claims.Name
+	}
+	return claims.Subject
+}
+
+// RequestIssuer verifies who made a service request, see VerifyRequest, returning the name they should be recorded as.
+func RequestIssuer(req micro.Request, trusted *jwt.UserClaims) (string, error) {
+	claims, err := VerifyRequest(req.Subject(), nats.Header(req.Headers()), req.Data(), trusted)
+	if err != nil {
+		return "", err
+	}
+	return IssuerName(claims), nil
+}
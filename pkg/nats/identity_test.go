@@ -0,0 +1,121 @@
+package nats
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+func newUser(t *testing.T, account nkeys.KeyPair, name string) (nkeys.KeyPair, string, *jwt.UserClaims) {
+	t.Helper()
+
+	user, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := user.PublicKey()
+
+	claims := jwt.NewUserClaims(pub)
+	claims.Name = name
+
+	token, err := claims.Encode(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := jwt.DecodeUserClaims(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user, token, decoded
+}
+
+func signedRequest(t *testing.T, user nkeys.KeyPair, token string, subject string, data []byte) *nats.Msg {
+	t.Helper()
+
+	conn := &nats.Conn{Opts: nats.Options{
+		UserJWT: func() (string, error) {
+			return token, nil
+		},
+		SignatureCB: user.Sign,
+	}}
+
+	msg := &nats.Msg{Subject: subject, Data: data}
+	if err := SignRequest(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestVerifyRequest(t *testing.T) {
+	account, _ := nkeys.CreateAccount()
+	other, _ := nkeys.CreateAccount()
+
+	_, _, agent := newUser(t, account, "agent")
+	admin, adminToken, _ := newUser(t, account, "admin")
+	stranger, strangerToken, _ := newUser(t, other, "stranger")
+
+	const subject = "NITS.AGENT.ABC.NIXOS.DEPLOY"
+	data := []byte(`{"closure":"/nix/store/abc-system"}`)
+
+	t.Run("valid", func(t *testing.T) {
+		msg := signedRequest(t, admin, adminToken, subject, data)
+		claims, err := VerifyRequest(subject, msg.Header, data, agent)
+		if err != nil {
+			t.Fatal(err)
+		} else if name := IssuerName(claims); name != "admin" {
+			t.Fatalf("expected issuer admin, got %s", name)
+		}
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		if _, err := VerifyRequest(subject, nats.Header{}, data, agent); err != ErrUnsignedRequest {
+			t.Fatalf("expected ErrUnsignedRequest, got %v", err)
+		}
+	})
+
+	t.Run("untrusted account", func(t *testing.T) {
+		msg := signedRequest(t, stranger, strangerToken, subject, data)
+		if _, err := VerifyRequest(subject, msg.Header, data, agent); err == nil {
+			t.Fatal("expected a user from another account to be rejected")
+		}
+	})
+
+	t.Run("tampered data", func(t *testing.T) {
+		msg := signedRequest(t, admin, adminToken, subject, data)
+		if _, err := VerifyRequest(subject, msg.Header, []byte(`{"closure":"/nix/store/evil"}`), agent); err == nil {
+			t.Fatal("expected tampered data to be rejected")
+		}
+	})
+
+	t.Run("other subject", func(t *testing.T) {
+		msg := signedRequest(t, admin, adminToken, subject, data)
+		if _, err := VerifyRequest("NITS.AGENT.ABC.EXEC", msg.Header, data, agent); err == nil {
+			t.Fatal("expected a signature for another subject to be rejected")
+		}
+	})
+
+	t.Run("signed by another user", func(t *testing.T) {
+		// a user presenting someone else's jwt cannot produce their signature
+		msg := signedRequest(t, stranger, adminToken, subject, data)
+		if _, err := VerifyRequest(subject, msg.Header, data, agent); err == nil {
+			t.Fatal("expected a signature by another user to be rejected")
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		msg := signedRequest(t, admin, adminToken, subject, data)
+		timestamp := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+		sig, _ := admin.Sign(issuerPayload(subject, timestamp, data))
+		msg.Header.Set(HeaderIssuerTime, timestamp)
+		msg.Header.Set(HeaderIssuerSig, base64.RawURLEncoding.EncodeToString(sig))
+		if _, err := VerifyRequest(subject, msg.Header, data, agent); err == nil {
+			t.Fatal("expected a stale request to be rejected")
+		}
+	})
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 
-	"github.com/charmbracelet/log"
 	"github.com/juju/errors"
 
 	"github.com/nats-io/nats.go"
@@ -54,11 +53,10 @@ func (w *Writer) Close() (err error) {
 func (w *Writer) Write(p []byte) (n int, err error) {
 	msg := w.newMsg()
 	msg.Data = p
-	n = len(p)
 	if err = w.Conn.PublishMsg(msg); err != nil {
-		log.Error("failed to publish message", "subject", w.Subject)
+		return 0, errors.Annotatef(err, "failed to publish message: %s", w.Subject)
 	}
-	return
+	return len(p), nil
 }
 
 type Reader struct {
@@ -40,12 +40,28 @@ func RequestWithContext[Req any, Resp any](ctx context.Context, conn *nats.Encod
 		_ = sub.Unsubscribe()
 	}()
 
-	if err = conn.PublishRequest(subject, inbox, req); err != nil {
+	request := &nats.Msg{Subject: subject, Reply: inbox}
+
+	// requests are signed so that agents can tell who made them
+	if request.Data, err = conn.Enc.Encode(subject, req); err != nil {
+		return
+	} else if err = SignRequest(conn.Conn, request); err != nil {
+		return
+	} else if err = conn.Conn.PublishMsg(request); err != nil {
 		return
 	} else if msg, err = sub.NextMsgWithContext(ctx); err != nil {
 		return
 	}
 
+	if err = ResponseError(msg); err != nil {
+		return
+	}
+
+	return conn.Enc.Decode(msg.Subject, msg.Data, resp)
+}
+
+// ResponseError returns a RequestError if the message is an error response from a service, otherwise nil.
+func ResponseError(msg *nats.Msg) error {
 	h := msg.Header
 	if h.Get(micro.ErrorHeader) != "" {
 		return &RequestError{
@@ -54,6 +70,5 @@ func RequestWithContext[Req any, Resp any](ctx context.Context, conn *nats.Encod
 			Data:        msg.Data,
 		}
 	}
-
-	return conn.Enc.Decode(msg.Subject, msg.Data, resp)
+	return nil
 }
@@ -0,0 +1,175 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/nix-community/go-nix/pkg/storepath"
+)
+
+// BootedSystem links to the system the machine was booted with.
+const BootedSystem = "/run/booted-system"
+
+// UnitChanges are the changes to systemd units which switch-to-configuration makes, or would make, when activating
+// a configuration.
+type UnitChanges struct {
+	Stop    []string `json:"stop,omitempty"`
+	Start   []string `json:"start,omitempty"`
+	Restart []string `json:"restart,omitempty"`
+	Reload  []string `json:"reload,omitempty"`
+}
+
+// DryActivation describes what activating a configuration would do.
+type DryActivation struct {
+	Units UnitChanges `json:"units"`
+	// true if the kernel, initrd or kernel parameters differ from those the machine was booted with
+	RebootRequired bool `json:"reboot-required"`
+}
+
+// DryActivate runs switch-to-configuration dry-activate for the closure. Its output is written to the context's
+// stdout as usual and parsed to determine what activating the closure would do.
+func DryActivate(closure *storepath.StorePath, ctx context.Context) (activation DryActivation, err error) {
+	var output bytes.Buffer
+
+	// stdout and stderr must share a writer so that they are not written to concurrently
+	writer := io.MultiWriter(GetStdOut(ctx), &output)
+	ctx = SetStdOut(ctx, writer)
+	ctx = SetStdError(ctx, writer)
+
+	if err = Switch(closure, "dry-activate", ctx); err != nil {
+		return
+	}
+
+	activation.Units = ParseDryActivate(output.String())
+	activation.RebootRequired, err = NeedsReboot(closure)
+	return
+}
+
+// ActivationReport describes what happened when a configuration was activated with switch or test.
+type ActivationReport struct {
+	Units UnitChanges `json:"units"`
+	// units which failed after activation
+	Failed []string `json:"failed,omitempty"`
+	// the exit status of switch-to-configuration
+	ExitStatus int `json:"exit-status"`
+}
+
+// Activate runs switch-to-configuration with the given action for the closure. Its output is written to the
+// context's stdout as usual and parsed to report what the activation did. The report is returned even if the
+// activation fails.
+func Activate(closure *storepath.StorePath, action string, ctx context.Context) (report ActivationReport, err error) {
+	var output bytes.Buffer
+
+	// stdout and stderr must share a writer so that they are not written to concurrently
+	writer := io.MultiWriter(GetStdOut(ctx), &output)
+	ctx = SetStdOut(ctx, writer)
+	ctx = SetStdError(ctx, writer)
+
+	err = Switch(closure, action, ctx)
+
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		report.ExitStatus = exit.ExitCode()
+	}
+
+	report.Units, report.Failed = ParseActivation(output.String())
+	return
+}
+
+// ParseDryActivate parses the output of switch-to-configuration dry-activate.
+func ParseDryActivate(output string) (changes UnitChanges) {
+	parseUnits(output, map[string]*[]string{
+		"would stop the following units: ":    &changes.Stop,
+		"would start the following units: ":   &changes.Start,
+		"would restart the following units: ": &changes.Restart,
+		"would reload the following units: ":  &changes.Reload,
+	})
+	return
+}
+
+// ParseActivation parses the output of switch-to-configuration switch or test, returning the units which were
+// changed and those which failed.
+func ParseActivation(output string) (changes UnitChanges, failed []string) {
+	parseUnits(output, map[string]*[]string{
+		"stopping the following units: ":         &changes.Stop,
+		"starting the following units: ":         &changes.Start,
+		"the following new units were started: ": &changes.Start,
+		"restarting the following units: ":       &changes.Restart,
+		"reloading the following units: ":        &changes.Reload,
+		"warning: the following units failed: ":  &failed,
+	})
+	return
+}
+
+// parseUnits looks for lines which begin with one of the given prefixes and are followed by a comma separated list of
+// units, appending the units to the corresponding slice.
+func parseUnits(output string, prefixes map[string]*[]string) {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		for prefix, units := range prefixes {
+			if list, ok := strings.CutPrefix(line, prefix); ok {
+				*units = append(*units, strings.Split(list, ", ")...)
+			}
+		}
+	}
+}
+
+// NeedsReboot returns true if the closure would not take full effect until the machine is rebooted, because its
+// kernel, initrd, kernel modules or kernel parameters differ from those the machine was booted with.
+func NeedsReboot(closure *storepath.StorePath) (bool, error) {
+	return needsReboot(BootedSystem, closure.Absolute())
+}
+
+// needsReboot compares the boot related parts of two system closures, see NeedsReboot.
+func needsReboot(bootedSystem string, nextSystem string) (bool, error) {
+	for _, name := range []string{"kernel", "initrd", "kernel-modules"} {
+		booted, err := resolve(filepath.Join(bootedSystem, name))
+		if err != nil {
+			return false, err
+		}
+
+		next, err := resolve(filepath.Join(nextSystem, name))
+		if err != nil {
+			return false, err
+		}
+
+		if booted != next {
+			return true, nil
+		}
+	}
+
+	booted, err := readOptional(filepath.Join(bootedSystem, "kernel-params"))
+	if err != nil {
+		return false, err
+	}
+
+	next, err := readOptional(filepath.Join(nextSystem, "kernel-params"))
+	if err != nil {
+		return false, err
+	}
+
+	return !bytes.Equal(booted, next), nil
+}
+
+// resolve evaluates any symlinks in path, returning an empty string if it does not exist e.g. in a container.
+func resolve(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return resolved, err
+}
+
+func readOptional(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
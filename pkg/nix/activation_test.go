@@ -0,0 +1,197 @@
+package nix
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const perlDryActivate = `would stop the following units: audit.service, kmod-static-nodes.service
+would NOT stop the following changed units: systemd-fsck@dev-disk-by\x2duuid-1234.service
+would activate the configuration...
+would restart systemd
+would reload the following units: dbus.service
+would restart the following units: nginx.service, sshd.service
+would start the following units: audit.service, grafana.service
+`
+
+const perlSwitch = `stopping the following units: audit.service, kmod-static-nodes.service
+NOT restarting the following changed units: systemd-fsck@dev-disk-by\x2duuid-1234.service
+activating the configuration...
+setting up /etc...
+reloading user units for alice...
+setting up tmpfiles
+reloading the following units: dbus.service
+restarting the following units: nginx.service, sshd.service
+starting the following units: audit.service, kmod-static-nodes.service
+the following new units were started: grafana.service
+warning: the following units failed: nginx.service
+
+× nginx.service - Nginx Web Server
+     Loaded: loaded (/etc/systemd/system/nginx.service; enabled; preset: enabled)
+     Active: failed (Result: exit-code) since Mon 2024-06-03 12:00:00 UTC; 10ms ago
+warning: error(s) occurred while switching to the new configuration
+`
+
+const ngSwitch = `stopping the following units: prometheus-node-exporter.service
+activating the configuration...
+setting up /etc...
+restarting systemd...
+reloading user units for alice...
+restarting sysinit-reactivation.target
+the following new units were started: sysinit-reactivation.target, systemd-tmpfiles-resetup.service
+starting the following units: prometheus-node-exporter.service
+warning: the following units failed: prometheus-node-exporter.service, wireguard-wg0.service
+`
+
+func TestParseDryActivate(t *testing.T) {
+	expected := UnitChanges{
+		Stop:    []string{"audit.service", "kmod-static-nodes.service"},
+		Start:   []string{"audit.service", "grafana.service"},
+		Restart: []string{"nginx.service", "sshd.service"},
+		Reload:  []string{"dbus.service"},
+	}
+
+	if changes := ParseDryActivate(perlDryActivate); !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, changes)
+	}
+
+	if changes := ParseDryActivate(""); !reflect.DeepEqual(changes, UnitChanges{}) {
+		t.Fatalf("expected no changes, got %+v", changes)
+	}
+}
+
+func TestParseActivation(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		changes UnitChanges
+		failed  []string
+	}{
+		{
+			name:   "perl",
+			output: perlSwitch,
+			changes: UnitChanges{
+				Stop:    []string{"audit.service", "kmod-static-nodes.service"},
+				Start:   []string{"audit.service", "kmod-static-nodes.service", "grafana.service"},
+				Restart: []string{"nginx.service", "sshd.service"},
+				Reload:  []string{"dbus.service"},
+			},
+			failed: []string{"nginx.service"},
+		},
+		{
+			name:   "ng",
+			output: ngSwitch,
+			changes: UnitChanges{
+				Stop: []string{"prometheus-node-exporter.service"},
+				Start: []string{
+					"sysinit-reactivation.target",
+					"systemd-tmpfiles-resetup.service",
+					"prometheus-node-exporter.service",
+				},
+			},
+			failed: []string{"prometheus-node-exporter.service", "wireguard-wg0.service"},
+		},
+		{
+			name:   "nothing changed",
+			output: "activating the configuration...\nsetting up /etc...\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes, failed := ParseActivation(tt.output)
+			if !reflect.DeepEqual(changes, tt.changes) {
+				t.Errorf("expected changes %+v, got %+v", tt.changes, changes)
+			}
+			if !reflect.DeepEqual(failed, tt.failed) {
+				t.Errorf("expected failed %v, got %v", tt.failed, failed)
+			}
+		})
+	}
+}
+
+// system builds a fake system closure in dir, linking each of the given files to a file of the same name and content
+// in a shared store so that identical files resolve to the same path.
+func system(t *testing.T, store string, dir string, files map[string]string) string {
+	t.Helper()
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		if name == "kernel-params" {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		target := filepath.Join(store, name+"-"+content)
+		if err := os.WriteFile(target, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		} else if err = os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestNeedsReboot(t *testing.T) {
+	booted := map[string]string{
+		"kernel":         "6.1.55",
+		"initrd":         "6.1.55",
+		"kernel-modules": "6.1.55",
+		"kernel-params":  "loglevel=4",
+	}
+
+	with := func(name string, value string) map[string]string {
+		files := make(map[string]string)
+		for k, v := range booted {
+			files[k] = v
+		}
+		if value == "" {
+			delete(files, name)
+		} else {
+			files[name] = value
+		}
+		return files
+	}
+
+	tests := []struct {
+		name     string
+		booted   map[string]string
+		next     map[string]string
+		expected bool
+	}{
+		{name: "same", booted: booted, next: booted, expected: false},
+		{name: "kernel", booted: booted, next: with("kernel", "6.6.10"), expected: true},
+		{name: "initrd", booted: booted, next: with("initrd", "rebuilt"), expected: true},
+		{name: "kernel modules", booted: booted, next: with("kernel-modules", "6.6.10"), expected: true},
+		{name: "kernel params", booted: booted, next: with("kernel-params", "loglevel=7"), expected: true},
+		{name: "kernel params removed", booted: booted, next: with("kernel-params", ""), expected: true},
+		{name: "container", booted: map[string]string{}, next: map[string]string{}, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			store := filepath.Join(root, "store")
+			if err := os.Mkdir(store, 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			bootedSystem := system(t, store, filepath.Join(root, "booted"), tt.booted)
+			nextSystem := system(t, store, filepath.Join(root, "next"), tt.next)
+
+			if reboot, err := needsReboot(bootedSystem, nextSystem); err != nil {
+				t.Fatal(err)
+			} else if reboot != tt.expected {
+				t.Fatalf("expected %v, got %v", tt.expected, reboot)
+			}
+		})
+	}
+}
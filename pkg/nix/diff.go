@@ -0,0 +1,80 @@
+package nix
+
+import (
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// PackageChange is a change in the versions of a package between two closures, in the style of
+// nix store diff-closures. A package which has been added has no versions before, one which has been removed has no
+// versions after.
+type PackageChange struct {
+	Name   string   `json:"name"`
+	Before []string `json:"before,omitempty"`
+	After  []string `json:"after,omitempty"`
+}
+
+// DiffClosures compares the store paths of two closures, returning the packages whose versions differ, sorted by name.
+func DiffClosures(before []string, after []string) (changes []PackageChange) {
+	versionsBefore := packageVersions(before)
+	versionsAfter := packageVersions(after)
+
+	names := make(map[string]bool)
+	for name := range versionsBefore {
+		names[name] = true
+	}
+	for name := range versionsAfter {
+		names[name] = true
+	}
+
+	for name := range names {
+		b, a := versionsBefore[name], versionsAfter[name]
+		if b != nil && a != nil && slices.Equal(b, a) {
+			continue
+		}
+		changes = append(changes, PackageChange{Name: name, Before: b, After: a})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+
+	return
+}
+
+// packageVersions groups store paths by package name, returning the sorted set of versions of each package.
+func packageVersions(paths []string) map[string][]string {
+	result := make(map[string][]string)
+	for _, path := range paths {
+		// strip the hash part
+		_, name, ok := strings.Cut(filepath.Base(path), "-")
+		if !ok {
+			continue
+		}
+
+		pname, version := ParseName(name)
+		if !slices.Contains(result[pname], version) {
+			result[pname] = append(result[pname], version)
+		}
+	}
+
+	for _, versions := range result {
+		sort.Strings(versions)
+	}
+
+	return result
+}
+
+// ParseName splits the name of a store path into a package name and version in the same way as
+// builtins.parseDrvName: the version begins after the first dash which is not followed by a letter.
+func ParseName(name string) (pname string, version string) {
+	for idx := 0; idx < len(name)-1; idx++ {
+		if name[idx] == '-' && !unicode.IsLetter(rune(name[idx+1])) {
+			return name[:idx], name[idx+1:]
+		}
+	}
+	return name, ""
+}
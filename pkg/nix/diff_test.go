@@ -0,0 +1,100 @@
+package nix
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseName(t *testing.T) {
+	tests := []struct {
+		name    string
+		pname   string
+		version string
+	}{
+		{name: "hello-2.12.1", pname: "hello", version: "2.12.1"},
+		{name: "nixos-system-gateway-23.11.20240101", pname: "nixos-system-gateway", version: "23.11.20240101"},
+		{name: "linux-6.1.55-modules", pname: "linux", version: "6.1.55-modules"},
+		{name: "python3.11-requests-2.31.0", pname: "python3.11-requests", version: "2.31.0"},
+		{name: "etc", pname: "etc", version: ""},
+		{name: "unit-dbus.service", pname: "unit-dbus.service", version: ""},
+		{name: "system-units", pname: "system-units", version: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pname, version := ParseName(tt.name)
+			if pname != tt.pname || version != tt.version {
+				t.Fatalf("expected (%q, %q), got (%q, %q)", tt.pname, tt.version, pname, version)
+			}
+		})
+	}
+}
+
+func TestDiffClosures(t *testing.T) {
+	tests := []struct {
+		name     string
+		before   []string
+		after    []string
+		expected []PackageChange
+	}{
+		{
+			name:     "identical",
+			before:   []string{"/nix/store/aaa-hello-2.12", "/nix/store/bbb-etc"},
+			after:    []string{"/nix/store/aaa-hello-2.12", "/nix/store/bbb-etc"},
+			expected: nil,
+		},
+		{
+			name:     "rebuilt without a version change",
+			before:   []string{"/nix/store/aaa-hello-2.12", "/nix/store/bbb-etc"},
+			after:    []string{"/nix/store/ccc-hello-2.12", "/nix/store/ddd-etc"},
+			expected: nil,
+		},
+		{
+			name:     "upgraded",
+			before:   []string{"/nix/store/aaa-hello-2.10"},
+			after:    []string{"/nix/store/bbb-hello-2.12"},
+			expected: []PackageChange{{Name: "hello", Before: []string{"2.10"}, After: []string{"2.12"}}},
+		},
+		{
+			name:   "added and removed",
+			before: []string{"/nix/store/aaa-hello-2.12", "/nix/store/bbb-nginx-1.24.0"},
+			after:  []string{"/nix/store/aaa-hello-2.12", "/nix/store/ccc-caddy-2.7.6"},
+			expected: []PackageChange{
+				{Name: "caddy", After: []string{"2.7.6"}},
+				{Name: "nginx", Before: []string{"1.24.0"}},
+			},
+		},
+		{
+			name:   "several versions",
+			before: []string{"/nix/store/aaa-openssl-3.0.12", "/nix/store/bbb-openssl-1.1.1w"},
+			after:  []string{"/nix/store/ccc-openssl-3.0.13", "/nix/store/bbb-openssl-1.1.1w"},
+			expected: []PackageChange{
+				{Name: "openssl", Before: []string{"1.1.1w", "3.0.12"}, After: []string{"1.1.1w", "3.0.13"}},
+			},
+		},
+		{
+			name:   "sorted by name",
+			before: nil,
+			after:  []string{"/nix/store/aaa-zlib-1.3", "/nix/store/bbb-bash-5.2", "/nix/store/ccc-etc"},
+			expected: []PackageChange{
+				{Name: "bash", After: []string{"5.2"}},
+				{Name: "etc", After: []string{""}},
+				{Name: "zlib", After: []string{"1.3"}},
+			},
+		},
+		{
+			name:     "paths without a hash part are ignored",
+			before:   nil,
+			after:    []string{"/nix/store/hello"},
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if changes := DiffClosures(tt.before, tt.after); !reflect.DeepEqual(changes, tt.expected) {
+				t.Fatalf("expected %+v, got %+v", tt.expected, changes)
+			}
+		})
+	}
+}
@@ -4,11 +4,18 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"io"
 	"os"
 	"os/exec"
+	"os/user"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/shirou/gopsutil/v3/host"
 
@@ -21,7 +28,20 @@ const (
 	ErrorMalformedClosure = errors.ConstError("closure is malformed")
 )
 
-var infoRegex = regexp.MustCompile(`^system: "(.*?)", multi-user\?: (.*?), version: (.*?),.*$`)
+// SystemProfile is the profile whose generations are the NixOS system configurations.
+const SystemProfile = "/nix/var/nix/profiles/system"
+
+// StagedSystemRoot is a GC root which keeps a staged system closure in the store until it is activated.
+const StagedSystemRoot = "/nix/var/nix/gcroots/nits-staged-system"
+
+// StagedProfileRoot is a GC root which keeps the closure for a profile deployment in the store whilst it waits to be
+// activated. It is separate from StagedSystemRoot so that a profile deployment never displaces a staged system.
+const StagedProfileRoot = "/nix/var/nix/gcroots/nits-staged-profile"
+
+var (
+	infoRegex       = regexp.MustCompile(`^system: "(.*?)", multi-user\?: (.*?), version: (.*?),.*$`)
+	generationRegex = regexp.MustCompile(`^(.*)-(\d+)-link$`)
+)
 
 func SetStdError(ctx context.Context, writer io.Writer) context.Context {
 	return context.WithValue(ctx, "stderr", writer)
@@ -74,6 +94,161 @@ func GetSystem() (path string, err error) {
 	return os.Readlink("/run/current-system")
 }
 
+func GetSystemProfile() (path string, err error) {
+	return filepath.EvalSymlinks(SystemProfile)
+}
+
+// GetStagedSystem returns the system closure which has been staged, or an empty string if there is none.
+func GetStagedSystem() (path string, err error) {
+	return readRoot(StagedSystemRoot)
+}
+
+// StageSystem adds a GC root for the given system closure, which must already be present in the store.
+func StageSystem(path *storepath.StorePath, ctx context.Context) error {
+	return addRoot(StagedSystemRoot, path, ctx)
+}
+
+// UnstageSystem removes the GC root for the staged system closure, if any.
+func UnstageSystem() error {
+	return removeRoot(StagedSystemRoot)
+}
+
+// GetStagedProfile returns the profile closure which has been staged, or an empty string if there is none.
+func GetStagedProfile() (path string, err error) {
+	return readRoot(StagedProfileRoot)
+}
+
+// StageProfile adds a GC root for the given profile closure, which must already be present in the store.
+func StageProfile(path *storepath.StorePath, ctx context.Context) error {
+	return addRoot(StagedProfileRoot, path, ctx)
+}
+
+// UnstageProfile removes the GC root for the staged profile closure, if any.
+func UnstageProfile() error {
+	return removeRoot(StagedProfileRoot)
+}
+
+func readRoot(root string) (path string, err error) {
+	if path, err = os.Readlink(root); os.IsNotExist(err) {
+		return "", nil
+	}
+	return
+}
+
+func addRoot(root string, path *storepath.StorePath, ctx context.Context) error {
+	args := []string{"--add-root", root, "--realise", path.Absolute()}
+	return runCmd("nix-store", args, nil, ctx)
+}
+
+func removeRoot(root string) error {
+	if err := os.Remove(root); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ListGenerations returns the generations of the system profile in ascending order.
+func ListGenerations() (generations []Generation, err error) {
+	var current, booted string
+	if current, err = os.Readlink(SystemProfile); err != nil {
+		return
+	} else if booted, err = filepath.EvalSymlinks(BootedSystem); err != nil {
+		return
+	}
+
+	var entries []os.DirEntry
+	if entries, err = os.ReadDir(filepath.Dir(SystemProfile)); err != nil {
+		return
+	}
+
+	prefix := filepath.Base(SystemProfile)
+	for _, entry := range entries {
+		matches := generationRegex.FindStringSubmatch(entry.Name())
+		if matches == nil || matches[1] != prefix {
+			continue
+		}
+
+		link := filepath.Join(filepath.Dir(SystemProfile), entry.Name())
+
+		var (
+			info os.FileInfo
+			gen  = Generation{Current: entry.Name() == current}
+		)
+
+		if gen.Number, err = strconv.Atoi(matches[2]); err != nil {
+			return
+		} else if info, err = os.Lstat(link); err != nil {
+			return
+		} else if gen.Path, err = os.Readlink(link); err != nil {
+			return
+		}
+
+		gen.Date = info.ModTime()
+		gen.Booted = gen.Path == booted
+		generations = append(generations, gen)
+	}
+
+	sort.Slice(generations, func(i, j int) bool {
+		return generations[i].Number < generations[j].Number
+	})
+
+	return
+}
+
+// CurrentGeneration returns the number of the current generation of the given profile.
+func CurrentGeneration(profile string) (number int, err error) {
+	var link string
+	if link, err = os.Readlink(profile); err != nil {
+		return
+	}
+
+	matches := generationRegex.FindStringSubmatch(filepath.Base(link))
+	if matches == nil {
+		return 0, errors.Errorf("profile does not link to a generation: %s", link)
+	}
+
+	return strconv.Atoi(matches[2])
+}
+
+// SwitchGeneration makes the given generation of the profile the current one, without activating it.
+func SwitchGeneration(profile string, number int, ctx context.Context) error {
+	args := []string{
+		"--profile", profile,
+		"--switch-generation", strconv.Itoa(number),
+	}
+	return runCmd("nix-env", args, nil, ctx)
+}
+
+// GetProfile returns the store path the given profile currently links to, or an empty string if it does not exist.
+func GetProfile(profile string) (path string, err error) {
+	path, err = filepath.EvalSymlinks(profile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return
+}
+
+// DeleteGenerations deletes generations of the system profile, the current generation is never deleted. The spec
+// takes the same form as nix-env --delete-generations e.g. +5 to keep the last five generations, or 30d to delete
+// generations older than thirty days.
+func DeleteGenerations(spec string, ctx context.Context) error {
+	args := []string{
+		"--profile", SystemProfile,
+		"--delete-generations", spec,
+	}
+	return runCmd("nix-env", args, nil, ctx)
+}
+
+// CollectGarbage deletes unreachable paths from the nix store, stopping once at least maxFreed bytes have been freed.
+// A maxFreed of zero means there is no limit.
+func CollectGarbage(maxFreed uint64, ctx context.Context) error {
+	args := []string{"--gc"}
+	if maxFreed > 0 {
+		args = append(args, "--max-freed", strconv.FormatUint(maxFreed, 10))
+	}
+	return runCmd("nix-store", args, nil, ctx)
+}
+
 func GetInfo() (info *Info, err error) {
 	cmd := exec.Command("/run/current-system/sw/bin/nix-info")
 	var b []byte
@@ -106,12 +281,27 @@ func GetNixOSVersion() (string, error) {
 	}
 }
 
-func runCmd(name string, args []string, env []string, ctx context.Context) (err error) {
-	cmd := exec.Command(name, args...)
+func runCmd(name string, args []string, env []string, ctx context.Context) error {
+	return run(command(name, args, env, ctx))
+}
+
+func command(name string, args []string, env []string, ctx context.Context) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
 	cmd.Env = env
 	cmd.Stdout = GetStdOut(ctx)
 	cmd.Stderr = GetStdErr(ctx)
 
+	// run the command in its own process group so that cancelling the context kills any child processes as well
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 10 * time.Second
+
+	return cmd
+}
+
+func run(cmd *exec.Cmd) (err error) {
 	if _, err = cmd.Stderr.Write([]byte(cmd.String() + "\n")); err != nil {
 		return
 	} else {
@@ -124,13 +314,80 @@ func Build(path *storepath.StorePath, env []string, ctx context.Context) error {
 }
 
 func SetSystem(path *storepath.StorePath, ctx context.Context) error {
+	return SetProfile(SystemProfile, path, ctx)
+}
+
+// SetProfile creates a new generation of the profile which links to the given path, creating the profile if needed.
+func SetProfile(profile string, path *storepath.StorePath, ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(profile), 0o755); err != nil {
+		return err
+	}
+
 	args := []string{
-		"--profile", "/nix/var/nix/profiles/system",
+		"--profile", profile,
 		"--set", path.Absolute(),
 	}
 	return runCmd("nix-env", args, nil, ctx)
 }
 
+// RunActivation runs an activation script within the closure, such as the activate script of a home-manager
+// generation. If username is not empty the script is run as that user, with only that user's groups and a minimal
+// environment rather than the agent's.
+func RunActivation(closure *storepath.StorePath, script string, username string, ctx context.Context) error {
+	cmd := command(filepath.Join(closure.Absolute(), script), nil, nil, ctx)
+
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			return err
+		}
+
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return err
+		}
+
+		gid, err := strconv.ParseUint(u.Gid, 10, 32)
+		if err != nil {
+			return err
+		}
+
+		groupIds, err := u.GroupIds()
+		if err != nil {
+			return err
+		}
+
+		// otherwise the script would keep the agent's supplementary groups
+		groups := make([]uint32, len(groupIds))
+		for idx, groupId := range groupIds {
+			group, err := strconv.ParseUint(groupId, 10, 32)
+			if err != nil {
+				return err
+			}
+			groups[idx] = uint32(group)
+		}
+
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}
+		cmd.Dir = u.HomeDir
+		cmd.Env = []string{
+			"HOME=" + u.HomeDir,
+			"USER=" + u.Username,
+			"PATH=" + os.Getenv("PATH"),
+			"XDG_RUNTIME_DIR=/run/user/" + u.Uid,
+		}
+	}
+
+	return run(cmd)
+}
+
+func RollbackSystem(ctx context.Context) error {
+	args := []string{
+		"--profile", SystemProfile,
+		"--rollback",
+	}
+	return runCmd("nix-env", args, nil, ctx)
+}
+
 func Switch(closure *storepath.StorePath, action string, ctx context.Context) error {
 	if err := IsSystemClosure(closure); err != nil {
 		return err
@@ -141,6 +398,66 @@ func Switch(closure *storepath.StorePath, action string, ctx context.Context) er
 	return runCmd(binPath, args, nil, ctx)
 }
 
+// QueryPathInfo returns info for the given store paths, and everything they reference if recursive is true.
+func QueryPathInfo(recursive bool, paths ...string) (infos []PathInfo, err error) {
+	args := []string{"path-info", "--json"}
+	if recursive {
+		args = append(args, "--recursive")
+	}
+	cmd := exec.Command("nix", append(args, paths...)...)
+
+	var b []byte
+	if b, err = cmd.Output(); err != nil {
+		return
+	}
+
+	// older versions of nix output a list, newer versions output an object keyed by path
+	if b = bytes.TrimSpace(b); len(b) > 0 && b[0] == '[' {
+		err = json.Unmarshal(b, &infos)
+		return
+	}
+
+	var byPath map[string]PathInfo
+	if err = json.Unmarshal(b, &byPath); err != nil {
+		return
+	}
+
+	for path, info := range byPath {
+		info.Path = path
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Path < infos[j].Path
+	})
+
+	return
+}
+
+// InvalidPaths returns those paths which are not valid in the local nix store.
+func InvalidPaths(paths ...string) (invalid []string, err error) {
+	args := append([]string{"--check-validity", "--print-invalid"}, paths...)
+	cmd := exec.Command("nix-store", args...)
+
+	var b []byte
+	if b, err = cmd.Output(); err != nil {
+		return
+	}
+
+	return strings.Fields(string(b)), nil
+}
+
+// Copy copies the closure of path into the local nix store from the given store url. Nix requires every path to be
+// signed by one of its trusted public keys unless checkSigs is false, which should only be the case if the caller
+// has verified the signatures itself.
+func Copy(from string, path *storepath.StorePath, checkSigs bool, ctx context.Context) error {
+	args := []string{"copy", "--from", from, path.Absolute()}
+	if !checkSigs {
+		args = append(args, "--no-check-sigs")
+	}
+	return runCmd("nix", args, nil, ctx)
+}
+
 func IsSystemClosure(closure *storepath.StorePath) error {
 	binPath := closure.Absolute() + "/bin/switch-to-configuration"
 	_, err := os.Stat(binPath)
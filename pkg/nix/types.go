@@ -1,8 +1,31 @@
 package nix
 
+import "time"
+
 type Info struct {
 	System    string `json:"system"`
 	MultiUser bool   `json:"multi-user"`
 	Version   string `json:"version"`
 	// todo add channels
 }
+
+// PathInfo describes a valid path in the nix store, as reported by nix path-info.
+type PathInfo struct {
+	Path       string   `json:"path"`
+	NarHash    string   `json:"narHash"`
+	NarSize    uint64   `json:"narSize"`
+	References []string `json:"references"`
+	Deriver    string   `json:"deriver,omitempty"`
+	Signatures []string `json:"signatures,omitempty"`
+}
+
+// Generation is a generation of the system profile.
+type Generation struct {
+	Number int       `json:"number"`
+	Date   time.Time `json:"date"`
+	Path   string    `json:"path"`
+	// true if this is the current generation of the profile
+	Current bool `json:"current"`
+	// true if the machine was booted into this generation
+	Booted bool `json:"booted"`
+}
@@ -17,6 +17,33 @@ func AgentDeploymentWithNKey(nkey string) string {
 	return fmt.Sprintf("%s.AGENT.%s.DEPLOYMENT", Prefix, nkey)
 }
 
+func AgentDeploymentRequest(nkey string, id string) string {
+	return fmt.Sprintf("%s.%s.REQUEST", AgentDeploymentWithNKey(nkey), id)
+}
+
+func AgentDeploymentConfirm(nkey string, id string) string {
+	return fmt.Sprintf("%s.%s.CONFIRM", AgentDeploymentWithNKey(nkey), id)
+}
+
+func AgentDeploymentResult(nkey string, id string) string {
+	return fmt.Sprintf("%s.%s.RESULT", AgentDeploymentWithNKey(nkey), id)
+}
+
+// AgentGcResult is the subject to which the result of a garbage collection is published once it has finished.
+func AgentGcResult(nkey string, id string) string {
+	return fmt.Sprintf("%s.GC.%s.RESULT", AgentWithNKey(nkey), id)
+}
+
+// AgentExecResult is the subject to which the result of a command is published once it has exited.
+func AgentExecResult(nkey string, id string) string {
+	return fmt.Sprintf("%s.EXEC.%s.RESULT", AgentWithNKey(nkey), id)
+}
+
+// AgentShell is the subject beneath which the input, output and window size changes of a shell session are relayed.
+func AgentShell(nkey string, id string) string {
+	return fmt.Sprintf("%s.SHELL.%s", AgentWithNKey(nkey), id)
+}
+
 func AgentWithName(name string) string {
 	return fmt.Sprintf("%s.AGENT.NAME.%s", Prefix, name)
 }
@@ -37,6 +64,10 @@ func AgentOutput(nkey string) string {
 	return fmt.Sprintf("%s.AGENT.%s.OUT", Prefix, nkey)
 }
 
+func AgentDeploymentsAll() string {
+	return fmt.Sprintf("%s.AGENT.*.DEPLOYMENT.>", Prefix)
+}
+
 func AgentLogsAll() string {
 	return fmt.Sprintf("%s.AGENT.*.LOG.>", Prefix)
 }
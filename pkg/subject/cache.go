@@ -0,0 +1,16 @@
+package subject
+
+import "fmt"
+
+// CacheServicePrefix is the subject beneath which the endpoints of the cache service are found.
+func CacheServicePrefix() string {
+	return fmt.Sprintf("%s.CACHE.SRV", Prefix)
+}
+
+func CacheService(name string) string {
+	return fmt.Sprintf("%s.%s", CacheServicePrefix(), name)
+}
+
+func CacheServiceAll() string {
+	return fmt.Sprintf("%s.>", CacheServicePrefix())
+}
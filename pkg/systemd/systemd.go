@@ -0,0 +1,44 @@
+package systemd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// FailedUnits returns the names of any units which are in a failed state.
+func FailedUnits(ctx context.Context) (units []string, err error) {
+	cmd := exec.CommandContext(ctx, "systemctl", "list-units", "--state=failed", "--plain", "--no-legend", "--no-pager")
+
+	var b []byte
+	if b, err = cmd.Output(); err != nil {
+		return
+	}
+
+	scanner := bufio.NewScanner(bytes.NewBuffer(b))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 {
+			units = append(units, fields[0])
+		}
+	}
+
+	return
+}
+
+// IsActive returns true if the given unit is active.
+func IsActive(ctx context.Context, unit string) (bool, error) {
+	err := exec.CommandContext(ctx, "systemctl", "is-active", "--quiet", unit).Run()
+
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		// a non-zero exit code indicates the unit is not active
+		return false, nil
+	}
+
+	return err == nil, err
+}